@@ -6,15 +6,21 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/sunliver/shark/lib/block"
+	"github.com/sunliver/shark/lib/stream"
 )
 
 const (
-	agentBusSz = 64
+	// constFastConnectWait max wait of first data sent with fast connect
+	constFastConnectWait = time.Millisecond * 50
+	// agentBusSz holds a full window, its resend and control blocks
+	agentBusSz = block.ConstStreamWindow*2 + 4
 )
 
 // agent handle connection from local
@@ -27,20 +33,39 @@ type agent struct {
 	proxy  Proxy
 	log    logrus.FieldLogger
 	bus    chan *block.BlockData
+	window *block.Window
+	// retransmit keeps data blocks sent for resend
+	retransmit *block.Retransmit
+	once       sync.Once
+	// halves count directions shut down, see closeHalf
+	halves int32
+	// m manager of relay, giving other relays to stripe over
+	m *Manager
+	// reorder puts data blocks striped by server back in order, nil without multipath
+	reorder *block.Reorder
+	// paths other relays stream is striped over
+	paths *stream.Paths
 }
 
-func newAgent(conn net.Conn, p Proxy, r *relay) *agent {
+func newAgent(conn net.Conn, p Proxy, r *relay, m *Manager) *agent {
 	c, cancel := context.WithCancel(r.ctx)
-	id := block.NewGUID()
+	id := r.newStreamID()
 	a := &agent{
-		ID:     id,
-		proxy:  p,
-		conn:   conn,
-		ctx:    c,
-		cancel: cancel,
-		r:      r,
-		bus:    make(chan *block.BlockData, agentBusSz),
-		log:    logrus.WithField("agent", short(id)).WithField("conn", conn.RemoteAddr()),
+		ID:         id,
+		proxy:      p,
+		conn:       conn,
+		ctx:        c,
+		cancel:     cancel,
+		r:          r,
+		bus:        make(chan *block.BlockData, agentBusSz),
+		window:     block.NewWindow(),
+		retransmit: block.NewRetransmit(),
+		paths:      stream.NewPaths(r.bus),
+		m:          m,
+		log:        logrus.WithField("agent", short(id)).WithField("conn", conn.RemoteAddr()),
+	}
+	if r.multipath {
+		a.reorder = block.NewReorder()
 	}
 	a.r.registerAgent(a)
 	return a
@@ -56,45 +81,82 @@ func (a *agent) start() {
 
 	a.log.Infof("send handshake msg, %v", hostData)
 
-	connectData, _ := json.Marshal(hostData)
-	a.r.bus <- block.Marshal(&block.BlockData{
-		ID:   a.ID,
-		Type: block.ConstBlockTypeConnect,
-		Data: a.r.crypto.CryptBlocks([]byte(connectData)),
-	})
-
 	defer a.release()
 
-	// waiting for the first connected block
-	select {
-	case data := <-a.bus:
-		if data.Type == block.ConstBlockTypeConnected {
-			if err := a.proxy.HandShakeSuccess(a.conn); err != nil {
-				a.log.Infof("handshake success failed, %v", err)
-				return
-			}
-		} else if data.Type == block.ConstBlockTypeConnectFailed {
-			_ = a.proxy.HandShakeFailed(a.conn)
-			a.log.Warnf("recv connect failed")
+	if p, ok := a.proxy.(*SocksProxy); ok && p.cmd == socksCmdUDPAssociate {
+		a.associate(p, hostData)
+		return
+	}
+
+	var blockNum uint32
+
+	if p, ok := a.proxy.(*SocksProxy); ok && p.cmd == socksCmdBind {
+		if err := a.bind(p, hostData); err != nil {
+			a.log.Warnf("bind failed, %v", err)
 			return
-		} else {
-			a.log.Warnf("unrecognized block data, %v", hostData)
+		}
+	} else if a.r.fastConnect {
+		if err := a.fastConnect(hostData); err != nil {
+			a.log.Warnf("fast connect failed, %v", err)
+			return
+		}
+	} else {
+		connectData, _ := json.Marshal(hostData)
+		a.r.send(a.seal(&block.BlockData{
+			ID:   a.ID,
+			Type: block.ConstBlockTypeConnect,
+		}, connectData))
+		if a.ctx.Err() != nil {
+			a.log.Infof("send connect block canceled, %v", a.ctx.Err())
 			return
 		}
 
-		if a.proxy.GetProxyType() == proxyHTTP {
-			p, _ := a.proxy.(*HttpProxy)
-			if p.remain != nil && len(p.remain) > 0 {
-				a.r.bus <- block.Marshal(&block.BlockData{
-					ID:   a.ID,
-					Type: block.ConstBlockTypeData,
-					Data: a.r.crypto.CryptBlocks(p.remain),
-				})
+		// waiting for the first connected block,
+		// it is answered on the new connection if relay resumes meanwhile
+		timeout := time.After(time.Second * 30)
+		for connected := false; !connected; {
+			select {
+			case data := <-a.bus:
+				if data.Type == block.ConstBlockTypeResume {
+					continue
+				}
+				if data.Type == block.ConstBlockTypeConnected {
+					if err := a.proxy.HandShakeSuccess(a.conn); err != nil {
+						a.log.Infof("handshake success failed, %v", err)
+						return
+					}
+				} else if data.Type == block.ConstBlockTypeConnectFailed {
+					reason := a.reason(data)
+					_ = a.proxy.HandShakeFailed(a.conn, reason)
+					a.log.Warnf("recv connect failed, reason %v", reason)
+					return
+				} else {
+					a.log.Warnf("unrecognized block data, %v", hostData)
+					return
+				}
+				connected = true
+				a.stripeOver(data)
+
+				if a.proxy.GetProxyType() == proxyHTTP {
+					p, _ := a.proxy.(*HttpProxy)
+					if p.remain != nil && len(p.remain) > 0 {
+						a.sendData(a.seal(&block.BlockData{
+							ID:       a.ID,
+							Type:     block.ConstBlockTypeData,
+							BlockNum: blockNum,
+						}, p.remain))
+						blockNum++
+					}
+				}
+			case <-timeout:
+				a.log.Errorf("wait connected block timeout")
+				_ = a.proxy.HandShakeFailed(a.conn, block.ConstFailedTimeout)
+				return
+			case <-a.ctx.Done():
+				a.log.Infof("wait connected block canceled, %v", a.ctx.Err())
+				return
 			}
 		}
-	case <-time.After(time.Second * 30):
-		a.log.Errorf("wait connected block timeout")
-		return
 	}
 
 	// begin read from remote, then
@@ -114,18 +176,38 @@ func (a *agent) start() {
 			a.log.Infof("read recv done, %v", a.ctx.Err())
 			return
 		default:
+			if a.r.flowControl {
+				if err := a.window.Wait(a.ctx, blockNum); err != nil {
+					a.log.Infof("read recv done, %v", err)
+					return
+				}
+			}
+
 			buf := make([]byte, 4096)
 			n, err := io.ReadAtLeast(a.conn, buf, 1)
+			if err == io.EOF && a.r.halfClose && a.ctx.Err() == nil {
+				a.log.Debugf("local closed write")
+				a.sendData(&block.BlockData{
+					ID:       a.ID,
+					Type:     block.ConstBlockTypeCloseWrite,
+					BlockNum: blockNum,
+				})
+				a.closeHalf()
+				// server may still write to local
+				<-a.ctx.Done()
+				return
+			}
 			if err != nil {
 				a.log.Warnf("read from local failed, err: %v", err)
 				return
 			}
 
-			a.r.bus <- block.Marshal(&block.BlockData{
-				ID:   a.ID,
-				Type: block.ConstBlockTypeData,
-				Data: a.r.crypto.CryptBlocks(buf[:n]),
-			})
+			a.sendData(a.seal(&block.BlockData{
+				ID:       a.ID,
+				Type:     block.ConstBlockTypeData,
+				BlockNum: blockNum,
+			}, buf[:n]))
+			blockNum++
 		}
 	}
 }
@@ -135,6 +217,8 @@ func (a *agent) write() {
 	defer a.log.Debugf("write routine stop")
 	defer a.release()
 
+	recv := stream.NewReceiver(a.ID, a.r.resend, a.r.flowControl, a.r.send)
+
 	for {
 		select {
 		case <-a.ctx.Done():
@@ -147,11 +231,50 @@ func (a *agent) write() {
 			}
 
 			if data.Type == block.ConstBlockTypeData {
-				d := a.r.crypto.DecrypBlocks(data.Data)
+				if next, err := recv.Data(data); err != nil {
+					a.log.Errorf("reject data block %v, %v", data, err)
+					return
+				} else if !next {
+					// sent again, or sent before the broken one is resent
+					a.log.Debugf("drop data block %v, expected block num %v", data, recv.Num())
+					continue
+				}
+
+				d, err := a.r.crypto.Open(data.Nonce(), data.Data)
+				if err != nil {
+					a.log.Errorf("reject data block %v, %v", data, err)
+					return
+				}
 				if n, err := a.conn.Write(d); err != nil || n < len(d) {
 					a.log.Warnf("write back failed, %v", err)
 					return
 				}
+				recv.Consumed()
+			} else if data.Type == block.ConstBlockTypeInvalid {
+				if recv.Invalid(data) {
+					a.log.Warnf("broken data block %v, request resend", data)
+				}
+			} else if data.Type == block.ConstBlockTypeResume {
+				a.log.Infof("relay resumed, request resend from %v", recv.Num())
+				recv.Resume()
+			} else if data.Type == block.ConstBlockTypeCloseWrite {
+				if next, err := recv.CloseWrite(data); err != nil {
+					a.log.Errorf("reject close write block %v, %v", data, err)
+					return
+				} else if !next {
+					continue
+				}
+
+				a.log.Debugf("remote closed write")
+				closeWrite(a.conn)
+				a.closeHalf()
+			} else if data.Type == block.ConstBlockTypeConnected {
+				// answer of fast connect
+				a.log.Debugf("remote connected")
+				a.stripeOver(data)
+			} else if data.Type == block.ConstBlockTypeConnectFailed {
+				a.log.Warnf("recv connect failed, reason %v", a.reason(data))
+				return
 			} else if data.Type == block.ConstBlockTypeDisconnect {
 				a.log.Infof("remote closed")
 				return
@@ -163,12 +286,190 @@ func (a *agent) write() {
 	}
 }
 
+// reason returns reason of ConnectFailed block b, unknown if server does not tell it
+func (a *agent) reason(b *block.BlockData) byte {
+	if b.Type != block.ConstBlockTypeConnectFailed || len(b.Data) == 0 {
+		return block.ConstFailedUnknown
+	}
+	d, err := a.r.crypto.Open(b.Nonce(), b.Data)
+	if err != nil || len(d) != 1 {
+		a.log.Warnf("broken connect failed block %v, %v", b, err)
+		return block.ConstFailedUnknown
+	}
+	return d[0]
+}
+
+// seal encrypts payload into block
+func (a *agent) seal(b *block.BlockData, payload []byte) *block.BlockData {
+	b.Data = a.r.crypto.Seal(b.Nonce(), payload)
+	return b
+}
+
+// deliver passes block to write routine; with flow control the bus holds a full window,
+// so it never blocks the relay unless peer overruns the window
+func (a *agent) deliver(b *block.BlockData) bool {
+	if a.reorder != nil {
+		return a.reorder.Push(b, a.push)
+	}
+	return a.push(b)
+}
+
+func (a *agent) push(b *block.BlockData) bool {
+	if b.Type == block.ConstBlockTypeDatagram {
+		// datagrams are dropped once agent is behind
+		select {
+		case a.bus <- b:
+		default:
+			a.log.Debugf("agent is behind, drop block %v", b)
+		}
+		return true
+	}
+	if !a.r.flowControl {
+		a.bus <- b
+		return true
+	}
+
+	select {
+	case a.bus <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// fastConnect sends host together with first data of local conn at once, then
+// goes on without waiting for connected block; so local conn is told success
+// before remote is connected, and closed if it fails later
+func (a *agent) fastConnect(hostData *block.HostData) error {
+	if err := a.proxy.HandShakeSuccess(a.conn); err != nil {
+		return err
+	}
+
+	fast := block.FastConnectData{HostData: *hostData}
+	if p, ok := a.proxy.(*HttpProxy); ok && len(p.remain) > 0 {
+		fast.Data = p.remain
+	} else {
+		// clients speaking first send at once, e.g. tls client hello
+		buf := make([]byte, 4096)
+		_ = a.conn.SetReadDeadline(time.Now().Add(constFastConnectWait))
+		n, err := a.conn.Read(buf)
+		_ = a.conn.SetReadDeadline(time.Time{})
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			return err
+		}
+		fast.Data = buf[:n]
+	}
+
+	a.log.Debugf("fast connect with %v bytes", len(fast.Data))
+	data, _ := json.Marshal(&fast)
+	a.r.send(a.seal(&block.BlockData{
+		ID:   a.ID,
+		Type: block.ConstBlockTypeFastConnect,
+	}, data))
+	return nil
+}
+
+// sendData sends data or close write block, keeps it for resend
+func (a *agent) sendData(b *block.BlockData) {
+	if a.r.resend {
+		a.retransmit.Send(b, a.stripe)
+	} else {
+		a.r.send(b)
+	}
+}
+
+// stripeOver joins other relays with token sealed in connected block, see block.FeatureMultipath
+func (a *agent) stripeOver(connected *block.BlockData) {
+	if !a.r.multipath || len(connected.Data) == 0 {
+		return
+	}
+	token, err := a.r.crypto.Open(connected.Nonce(), connected.Data)
+	if err != nil {
+		a.log.Warnf("broken multipath token, %v", err)
+		return
+	}
+	go a.join(token)
+}
+
+// join stripes stream over other relays of manager
+func (a *agent) join(token []byte) {
+	for _, r := range a.m.pathsFor(a.r, a.r.conf.Paths-1) {
+		if !r.multipath {
+			continue
+		}
+
+		id := r.newStreamID()
+		r.join(id, a)
+		b := &block.BlockData{
+			ID:   id,
+			Type: block.ConstBlockTypeJoin,
+		}
+		b.Data = r.crypto.Seal(b.Nonce(), token)
+		r.send(b)
+
+		if !a.paths.Join(&stream.Path{Conn: r, ID: id, Bus: r.bus, Done: r.ctx.Done()}) {
+			r.leave(id)
+			return
+		}
+		a.log.Debugf("stream joined relay %v", short(r.ID))
+	}
+}
+
+// stripe sends data block over the relays stream is striped over
+func (a *agent) stripe(b *block.BlockData) {
+	a.paths.Stripe(b, a.r.send, a.ctx.Done())
+}
+
+// dropPath stops striping over closed relay r, blocks server did not consume
+// may be gone with it and are sent again
+func (a *agent) dropPath(r *relay) {
+	if a.paths.Drop(r) {
+		a.log.Infof("relay %v is closed, resend from %v", short(r.ID), a.window.Acked())
+		a.resend(a.window.Acked())
+	}
+}
+
+// resend sends data blocks again from num, server got a broken one
+func (a *agent) resend(num uint32) {
+	if !a.r.resend || !a.retransmit.Resend(num, a.r.send) {
+		a.log.Errorf("can not resend data block %v, close stream", num)
+		a.cancel()
+	}
+}
+
+// closeHalf marks one direction shut down, stream is released once both are
+func (a *agent) closeHalf() {
+	if atomic.AddInt32(&a.halves, 1) == 2 {
+		a.release()
+	}
+}
+
+// closeWrite shuts down writing side of conn, if conn supports half-close
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	}
+}
+
+// release closes the stream and tells server to close it too,
+// server drops the block if it closed the stream first
 func (a *agent) release() {
-	a.cancel()
-	a.r.unregisterAgent(a)
-	_ = a.conn.Close()
+	a.once.Do(func() {
+		a.cancel()
+		// queued before a draining relay is released with its last stream
+		a.r.send(&block.BlockData{
+			ID:   a.ID,
+			Type: block.ConstBlockTypeDisconnect,
+		})
+		a.r.unregisterAgent(a)
+		// a draining relay may be released by leaving
+		for _, p := range a.paths.Close() {
+			p.Conn.(*relay).leave(p.ID)
+		}
+		_ = a.conn.Close()
 
-	a.log.Debugf("agent is closed")
+		a.log.Debugf("agent is closed")
+	})
 }
 
 func short(id uuid.UUID) string {
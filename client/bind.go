@@ -0,0 +1,76 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sunliver/shark/lib/block"
+)
+
+// bind serves socks BIND: server listens for the inbound connection of peer, local client
+// is told the address listened on and then the peer once it connects, see block.FeatureBind
+func (a *agent) bind(p *SocksProxy, peer *block.HostData) error {
+	if !a.r.bind {
+		_ = p.unsupported(a.conn)
+		return fmt.Errorf("server does not support bind")
+	}
+
+	peerData, _ := json.Marshal(peer)
+	a.r.send(a.seal(&block.BlockData{
+		ID:   a.ID,
+		Type: block.ConstBlockTypeBind,
+	}, peerData))
+
+	// server answers Bound at once, then it waits for the inbound connection
+	// no longer than its bind timeout
+	timeout := time.After(time.Second * 30)
+	for {
+		select {
+		case b := <-a.bus:
+			switch b.Type {
+			case block.ConstBlockTypeResume:
+				continue
+			case block.ConstBlockTypeBound, block.ConstBlockTypeConnected:
+				addr, err := a.openHost(b)
+				if err != nil {
+					_ = p.HandShakeFailed(a.conn, block.ConstFailedUnknown)
+					return err
+				}
+				if err := p.bound(a.conn, addr); err != nil {
+					return err
+				}
+				if b.Type == block.ConstBlockTypeConnected {
+					a.log.Infof("inbound connection from %v:%v", addr.Address, addr.Port)
+					return nil
+				}
+				a.log.Infof("bound on %v:%v", addr.Address, addr.Port)
+				timeout = nil
+			case block.ConstBlockTypeConnectFailed:
+				reason := a.reason(b)
+				_ = p.HandShakeFailed(a.conn, reason)
+				return fmt.Errorf("recv connect failed, reason %v", reason)
+			default:
+				return fmt.Errorf("unrecognized block data, %v", b)
+			}
+		case <-timeout:
+			_ = p.HandShakeFailed(a.conn, block.ConstFailedTimeout)
+			return fmt.Errorf("wait bound block timeout")
+		case <-a.ctx.Done():
+			return a.ctx.Err()
+		}
+	}
+}
+
+// openHost returns host data sealed in block b
+func (a *agent) openHost(b *block.BlockData) (*block.HostData, error) {
+	d, err := a.r.crypto.Open(b.Nonce(), b.Data)
+	if err != nil {
+		return nil, fmt.Errorf("broken block %v, %v", b, err)
+	}
+	var host block.HostData
+	if err := json.Unmarshal(d, &host); err != nil {
+		return nil, fmt.Errorf("broken block %v, %v", b, err)
+	}
+	return &host, nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -101,8 +102,19 @@ func (p *HttpProxy) HandShakeSuccess(conn net.Conn) error {
 	}
 }
 
-func (p *HttpProxy) HandShakeFailed(net.Conn) error {
-	return nil
+// httpStatuses status of stream failed for reasons, 502 Bad Gateway for others
+var httpStatuses = map[byte]int{
+	block.ConstFailedTimeout: http.StatusGatewayTimeout,
+	block.ConstFailedDenied:  http.StatusForbidden,
+}
+
+func (p *HttpProxy) HandShakeFailed(conn net.Conn, reason byte) error {
+	status, ok := httpStatuses[reason]
+	if !ok {
+		status = http.StatusBadGateway
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+	return err
 }
 
 func (p *HttpProxy) GetProxyType() ProxyType {
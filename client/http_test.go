@@ -1,8 +1,12 @@
 package client
 
 import (
+	"io/ioutil"
 	"net"
+	"strings"
 	"testing"
+
+	"github.com/sunliver/shark/lib/block"
 )
 
 func TestHttpProxy_HTTPHandShake(t *testing.T) {
@@ -58,3 +62,26 @@ func TestHttpProxy_HTTPSHandShake(t *testing.T) {
 	}
 	_ = c.Close()
 }
+
+func TestHttpProxy_HandShakeFailed(t *testing.T) {
+	cases := map[byte]string{
+		block.ConstFailedRefused: "HTTP/1.1 502 Bad Gateway\r\n",
+		block.ConstFailedDNS:     "HTTP/1.1 502 Bad Gateway\r\n",
+		block.ConstFailedTimeout: "HTTP/1.1 504 Gateway Timeout\r\n",
+		block.ConstFailedDenied:  "HTTP/1.1 403 Forbidden\r\n",
+		block.ConstFailedUnknown: "HTTP/1.1 502 Bad Gateway\r\n",
+	}
+
+	for reason, status := range cases {
+		c, s := net.Pipe()
+		p := HttpProxy{https: true}
+		go func() {
+			_ = p.HandShakeFailed(s, reason)
+			_ = s.Close()
+		}()
+		resp, _ := ioutil.ReadAll(c)
+		if !strings.HasPrefix(string(resp), status) {
+			t.Errorf("reason %v, got %q, expected %q", reason, resp, status)
+		}
+	}
+}
@@ -9,24 +9,32 @@ import (
 	"sync/atomic"
 	"time"
 
+	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/sunliver/shark/lib/stream"
 )
 
 // Manager relay pool manager
 type Manager struct {
 	ctx    context.Context
 	cancel func()
-	slots  []*relay
+	// slots guarded by smu, mu serializes creating relays
+	slots []*relay
+	smu   sync.RWMutex
+	// relays every live relay, replaced ones included, until it is released;
+	// closed once manager shuts down, so no more relays are created
+	relays *stream.Table
 	ticket *uint32
 	mu     sync.Mutex
 	remote string
+	conf   *RelayConf
 	log    logrus.FieldLogger
 }
 
 const maxCoreSz = 100
 
 // NewManager init relay pool manager with a fixed size
-func NewManager(coreSz int, remote string) *Manager {
+func NewManager(coreSz int, remote string, conf *RelayConf) *Manager {
 	c, cancel := context.WithCancel(context.Background())
 
 	if coreSz < 0 {
@@ -41,8 +49,10 @@ func NewManager(coreSz int, remote string) *Manager {
 		ctx:    c,
 		cancel: cancel,
 		slots:  make([]*relay, coreSz),
+		relays: stream.NewTable(),
 		ticket: new(uint32),
 		remote: remote,
+		conf:   conf,
 		log:    logrus.WithField("manager", "1"),
 	}
 }
@@ -55,16 +65,36 @@ func (m *Manager) Start(conn net.Conn, p Proxy) {
 		return
 	}
 
-	a := newAgent(conn, p, c)
+	a := newAgent(conn, p, c, m)
 	a.start()
 }
 
 // getClient return a relay which is ready to recv connections
 func (m *Manager) getClient() (*relay, error) {
-	// fast path: if current slot is ready, return it
 	ticket := atomic.AddUint32(m.ticket, 1) - 1
-	idx := ticket % uint32(len(m.slots))
-	if r := m.slots[idx]; r != nil && r.closed != true {
+	return m.getSlot(ticket % uint32(len(m.slots)))
+}
+
+// pathsFor returns up to n relays other than r, streams of r are striped over them
+func (m *Manager) pathsFor(r *relay, n int) []*relay {
+	paths := make([]*relay, 0, n)
+	for i := 0; i < len(m.slots) && len(paths) < n; i++ {
+		c, err := m.getSlot(uint32(i))
+		if err != nil {
+			m.log.Warnf("get relay %v failed, %v", i, err)
+			continue
+		}
+		if c != r {
+			paths = append(paths, c)
+		}
+	}
+	return paths
+}
+
+// getSlot return relay of slot idx, a new one if it is not ready
+func (m *Manager) getSlot(idx uint32) (*relay, error) {
+	// fast path: if current slot is ready, return it
+	if r := m.slot(idx); r != nil && r.available() {
 		return r, nil
 	}
 
@@ -73,7 +103,7 @@ func (m *Manager) getClient() (*relay, error) {
 	defer m.mu.Unlock()
 	// double check
 	// other routine may create the relay
-	if r := m.slots[idx]; r != nil && r.closed != true {
+	if r := m.slot(idx); r != nil && r.available() {
 		return r, nil
 	}
 
@@ -81,20 +111,64 @@ func (m *Manager) getClient() (*relay, error) {
 	retryDelay := time.Second * 1
 
 	for i := 0; i < retryCnt; i++ {
-		r, err := newRelay(m.ctx, m.remote)
+		r, err := newRelay(m.ctx, m.remote, m.conf)
 		if err != nil {
 			time.Sleep(retryDelay)
 			m.log.Errorf("retry %v: init client failed, %v", i, err)
 			continue
 		}
+		if !m.relays.Add(r.ID, r) {
+			r.release()
+			return nil, fmt.Errorf("manager is shut down")
+		}
+		go func() {
+			<-r.ctx.Done()
+			m.relays.Remove(r.ID)
+		}()
 
+		m.smu.Lock()
 		m.slots[idx] = r
+		m.smu.Unlock()
 
 		return r, nil
 	}
 	return nil, fmt.Errorf("connect with remote failed too many times")
 }
 
+func (m *Manager) slot(idx uint32) *relay {
+	m.smu.RLock()
+	defer m.smu.RUnlock()
+
+	return m.slots[idx]
+}
+
+// Shutdown tells server relays are going away and waits for their streams to be done,
+// relays left once ctx is done are cancelled; no more relays are created meanwhile
+func (m *Manager) Shutdown(ctx context.Context) {
+	m.relays.Close()
+	var relays []*relay
+	m.relays.Range(func(_ uuid.UUID, s interface{}) {
+		relays = append(relays, s.(*relay))
+	})
+
+	for _, r := range relays {
+		// relay told to go away by server drains already
+		if !r.isDraining() {
+			r.shutdown()
+		}
+	}
+	for _, r := range relays {
+		select {
+		case <-r.ctx.Done():
+		case <-ctx.Done():
+			m.log.Warnf("relays are not drained in time, %v", ctx.Err())
+			m.Cancel()
+			return
+		}
+	}
+	m.Cancel()
+}
+
 // Cancel cancel all hold relay
 func (m *Manager) Cancel() {
 	m.cancel()
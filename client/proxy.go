@@ -20,6 +20,7 @@ type Proxy interface {
 	HandShake(net.Conn) (*block.HostData, error)
 	// HandShakeResp returns Proxy handshake resp msg
 	HandShakeSuccess(net.Conn) error
-	HandShakeFailed(net.Conn) error
+	// HandShakeFailed tells Proxy client stream failed for reason, see block.ConstFailedUnknown
+	HandShakeFailed(conn net.Conn, reason byte) error
 	GetProxyType() ProxyType
 }
@@ -2,16 +2,21 @@ package client
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/sunliver/shark/lib/block"
 	"github.com/sunliver/shark/lib/crypto"
+	"github.com/sunliver/shark/lib/stream"
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
@@ -21,164 +26,456 @@ const (
 
 const (
 	relayBusSz = 64
+	// constResumeRetryDelay between attempts to resume session
+	constResumeRetryDelay = time.Second * 1
 )
 
+// errSessionLost server can not resume the session any more
+var errSessionLost = errors.New("session is lost on server")
+
+// RelayConf configuration used to connect with remote server
+type RelayConf struct {
+	// User account name on server, optional
+	User string
+	// Key pre-shared secret, must be the same as server's
+	Key []byte
+	// Ciphers seal block payloads in preference order, server picks one
+	Ciphers []string
+	// ServerPubKey pinned server identity, optional
+	ServerPubKey ed25519.PublicKey
+	// PingInterval between pings to server, 0 disables pings
+	PingInterval time.Duration
+	// PingTimeout closes relay once nothing is read from pinged server for so long,
+	// 0 for constReadTimeoutS
+	PingTimeout time.Duration
+	// FastConnect opens streams without waiting for remote connected,
+	// local conns are told success before remote is connected
+	FastConnect bool
+	// ResumeTimeout resumes session on a new connection within so long after
+	// losing connection to server, 0 disables resume
+	ResumeTimeout time.Duration
+	// Paths stripes each stream over so many relays, 0 or 1 for one
+	Paths int
+	// MaxBodySz max body size of blocks, 0 for block.ConstMaxBodySzB
+	MaxBodySz int
+}
+
 // relay struct
 // connect with remote server
 type relay struct {
 	ID     uuid.UUID
-	conn   net.Conn
+	remote string
+	// link current connection, nil while resuming; guarded by mu
+	link   *stream.Link
+	conf   *RelayConf
 	ctx    context.Context
-	bus    chan []byte
-	crypto *crypto.Crypto
+	bus    chan *block.BlockData
+	crypto *crypto.Session
 	log    logrus.FieldLogger
 	mu     sync.RWMutex
-	agents map[uuid.UUID]*agent
+	// agents streams opened on relay and joined to it, by stream id on relay
+	agents *stream.Table
 	cancel func()
+	// closed relay takes no new streams, guarded by mu
 	closed bool
+	// draining relay opens no more streams and is not resumed; if closeIdle it is
+	// released once its streams are done, else server closes it. Guarded by mu
+	draining  bool
+	closeIdle bool
+	// streamSeq makes stream ids unique in the relay
+	streamSeq uint32
+	// negotiated in handshake
+	version  uint32
+	cipher   string
+	features []string
+	// flowControl streams are throttled by windows, see block.Window
+	flowControl bool
+	// halfClose streams shut down each direction on its own
+	halfClose bool
+	// resend streams ask for resend of broken data blocks
+	resend bool
+	// fastConnect streams send first data along with host
+	fastConnect bool
+	// keepAlive server answers pings
+	keepAlive bool
+	// multipath streams are striped over other relays joining them
+	multipath bool
+	// goAway server is told when relay is shut down
+	goAway bool
+	// udp socks5 clients associate UDP over relay
+	udp bool
+	// bind socks clients accept inbound connections on server
+	bind bool
+	// ticket and secret of resumable session, see block.FeatureResume
+	ticket       []byte
+	resumeSecret []byte
 }
 
-func newRelay(ctx context.Context, remote string) (*relay, error) {
+func newRelay(ctx context.Context, remote string, conf *RelayConf) (*relay, error) {
 	c, cancel := context.WithCancel(ctx)
-	conn, err := net.Dial("tcp", remote)
-	if err != nil {
-		return nil, fmt.Errorf("init to remote server failed, err: %v", err)
-	}
 
 	id := uuid.NewV4()
 	r := &relay{
 		ID:     id,
-		conn:   conn,
+		remote: remote,
+		conf:   conf,
 		ctx:    c,
 		cancel: cancel,
-		agents: make(map[uuid.UUID]*agent),
-		bus:    make(chan []byte, relayBusSz),
-		log:    logrus.WithField("relay", short(id)).WithField("conn", conn.RemoteAddr()),
+		agents: stream.NewTable(),
+		bus:    make(chan *block.BlockData, relayBusSz),
+		log:    logrus.WithField("relay", short(id)).WithField("conn", remote),
 	}
 
-	if err := r.handshake(); err != nil {
-		r.log.Errorf("handshake failed, %v", err)
-		return r, err
+	l, err := r.connect()
+	if err != nil {
+		r.log.Errorf("connect server failed, %v", err)
+		r.release()
+		return nil, err
 	}
-
-	go r.read()
-	go r.write()
+	r.attach(l)
 
 	return r, nil
 }
 
-// handshake do handshake with remote Proxy server
-func (c *relay) handshake() error {
-	// step1: send syn
+// connect dials server and does handshake on the new connection
+func (c *relay) connect() (*stream.Link, error) {
+	conn, err := net.Dial("tcp", c.remote)
+	if err != nil {
+		return nil, fmt.Errorf("init to remote server failed, err: %v", err)
+	}
+	l := &stream.Link{
+		Conn:   conn,
+		Reader: block.NewReader(conn, c.conf.MaxBodySz),
+		Writer: block.NewWriter(conn),
+	}
+
+	// server not answering handshake is dead
+	_ = conn.SetDeadline(time.Now().Add(constReadTimeoutS))
+	if err := c.handshake(l); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return l, nil
+}
+
+// attach makes l the connection of relay and starts its routines
+func (c *relay) attach(l *stream.Link) {
+	l.Ctx, l.Cancel = context.WithCancel(c.ctx)
+
+	c.mu.Lock()
+	c.link = l
+	c.mu.Unlock()
+
+	go c.read(l)
+	go c.write(l)
+	if c.pinging() {
+		go c.ping(l)
+	}
+}
+
+// lost closes connection l, relay resumes its session on a new connection if it can
+func (c *relay) lost(l *stream.Link) {
+	l.Close()
+
+	c.mu.Lock()
+	current := c.link == l
+	if current {
+		c.link = nil
+	}
+	c.mu.Unlock()
+	if !current {
+		return
+	}
+
+	if c.ticket == nil || c.ctx.Err() != nil || c.isDraining() {
+		c.release()
+		return
+	}
+	go c.resume()
+}
+
+// resume reconnects to server and goes on with the session, agents see nothing but a pause;
+// relay is released if server is not reachable in time or lost the session
+func (c *relay) resume() {
+	c.log.Infof("connection lost, resume session")
+
+	deadline := time.Now().Add(c.conf.ResumeTimeout)
+	for c.ctx.Err() == nil && time.Now().Before(deadline) {
+		l, err := c.connect()
+		if err == nil {
+			c.attach(l)
+			c.log.Infof("session resumed")
+			c.resumeAgents()
+			return
+		}
+		c.log.Warnf("resume session failed, %v", err)
+		if err == errSessionLost {
+			break
+		}
+
+		select {
+		case <-time.After(constResumeRetryDelay):
+		case <-c.ctx.Done():
+		}
+	}
+	c.release()
+}
+
+// resumeAgents asks agents for resend of blocks lost with the previous connection
+func (c *relay) resumeAgents() {
+	c.agents.Range(func(_ uuid.UUID, s interface{}) {
+		a := s.(*agent)
+		if !a.deliver(&block.BlockData{ID: a.ID, Type: block.ConstBlockTypeResume}) {
+			a.log.Errorf("stream is overrun, close stream")
+			a.cancel()
+		}
+	})
+}
+
+// offered features, resume and multipath only if relay uses them
+func (c *relay) offered() []string {
+	features := block.Features
+	if c.conf.ResumeTimeout <= 0 {
+		features = block.Without(features, block.FeatureResume)
+	}
+	if c.conf.Paths < 2 {
+		features = block.Without(features, block.FeatureMultipath)
+	}
+	return features
+}
+
+// handshake do handshake with remote Proxy server,
+// it resumes the session if relay holds a ticket
+func (c *relay) handshake(l *stream.Link) error {
+	var clientHello, serverHello, shared []byte
+	var cipher string
+	var version uint32
+	var features []string
+	var hello block.HandShakeData
+
+	// step1: send syn with client nonce and ephemeral key, recv server's
 	{
-		if _, err := c.conn.Write(block.Marshal(&block.BlockData{
+		keyPair := crypto.NewKeyPair()
+		clientHello, _ = json.Marshal(&block.HandShakeData{
+			Version:   block.ConstProtocolMaxVersion,
+			User:      c.conf.User,
+			Nonce:     crypto.NewNonce(),
+			Timestamp: time.Now().Unix(),
+			PublicKey: keyPair.Public,
+			Ciphers:   c.conf.Ciphers,
+			Features:  c.offered(),
+			Ticket:    c.ticket,
+		})
+		if err := l.Writer.Write(&block.BlockData{
 			Type: block.ConstBlockTypeHandShake,
-		})); err != nil {
+			Data: clientHello,
+		}); err != nil {
 			return err
 		}
 
-		buf := make([]byte, block.ConstBlockHeaderSzB)
-		if n, err := io.ReadFull(c.conn, buf); err != nil || n < len(buf) {
+		blockData, err := l.Reader.Read()
+		if err != nil {
 			return err
 		}
+		if blockData.Type != block.ConstBlockTypeHandShake {
+			return fmt.Errorf("expected handshake, get %v", blockData.Type)
+		}
 
-		if blockData, err := block.UnMarshalHeader(buf); err != nil || blockData.Type != block.ConstBlockTypeHandShake {
+		if err := json.Unmarshal(blockData.Data, &hello); err != nil || len(hello.Nonce) == 0 {
+			return fmt.Errorf("invalid handshake, %v", err)
+		}
+		if hello.Version < block.ConstProtocolMinVersion || hello.Version > block.ConstProtocolMaxVersion {
+			return fmt.Errorf("unsupported protocol version %v", hello.Version)
+		}
+		if !block.Contains(c.conf.Ciphers, hello.Cipher) {
+			return fmt.Errorf("expected one of ciphers %v, get %v", c.conf.Ciphers, hello.Cipher)
+		}
+		if features := block.Select(hello.Features, c.offered()); len(features) != len(hello.Features) {
+			return fmt.Errorf("unexpected features %v", hello.Features)
+		}
+		version = hello.Version
+		features = hello.Features
+		cipher = hello.Cipher
+		if c.ticket != nil {
+			if !hello.Resumed {
+				return errSessionLost
+			}
+			if version != c.version || cipher != c.cipher || !reflect.DeepEqual(features, c.features) {
+				return fmt.Errorf("resumed session is not the same, version %v, cipher %v, features %v", version, cipher, features)
+			}
+		} else if hello.Resumed {
+			return fmt.Errorf("unexpected resumed session")
+		}
+		if shared, err = keyPair.SharedSecret(hello.PublicKey); err != nil {
 			return err
 		}
+		serverHello = blockData.Data
 	}
 
-	passwd := []byte(block.NewGUID().String())
-
-	// step2: send pass negotiation
+	// step2: prove we hold the key
 	{
-		if _, err := c.conn.Write(block.Marshal(&block.BlockData{
+		resp := &block.HandShakeData{
+			Proof: crypto.ClientProof(c.conf.Key, clientHello, serverHello),
+		}
+		if hello.Resumed {
+			resp.ResumeProof = crypto.ResumeProof(c.resumeSecret, clientHello, serverHello)
+		}
+		data, _ := json.Marshal(resp)
+		if err := l.Writer.Write(&block.BlockData{
 			ID:   block.NewGUID(),
 			Type: block.ConstBlockTypeHandShakeResponse,
-			Data: passwd,
-		})); err != nil {
+			Data: data,
+		}); err != nil {
 			return err
 		}
 	}
 
-	// step3: recv handshake final
+	// step3: recv handshake final, server proves it holds the key too
 	{
-		buf := make([]byte, block.ConstBlockHeaderSzB)
-
-		if n, err := io.ReadFull(c.conn, buf); err != nil || n < len(buf) {
+		blockData, err := l.Reader.Read()
+		if err != nil {
 			return err
 		}
+		if blockData.Type != block.ConstBlockTypeHandShakeFinal {
+			return fmt.Errorf("expected handshake final, get %v", blockData.Type)
+		}
 
-		if blockData, err := block.UnMarshalHeader(buf); err != nil || blockData.Type != block.ConstBlockTypeHandShakeFinal {
-			return err
+		var final block.HandShakeData
+		if err := json.Unmarshal(blockData.Data, &final); err != nil {
+			return fmt.Errorf("invalid handshake final, %v", err)
+		}
+		if !crypto.VerifyProof(crypto.ServerProof(c.conf.Key, clientHello, serverHello), final.Proof) {
+			return fmt.Errorf("server proof mismatch, check the key")
 		}
+
+		if c.conf.ServerPubKey != nil {
+			if !crypto.VerifyHandShake(c.conf.ServerPubKey, clientHello, serverHello, final.Signature) {
+				return fmt.Errorf("server identity mismatch, expected %v, get %v, possible man-in-the-middle",
+					crypto.EncodeKey(c.conf.ServerPubKey), crypto.EncodeKey(final.Identity))
+			}
+		} else if final.Identity != nil {
+			c.log.Infof("server identity is not pinned, %v", crypto.EncodeKey(final.Identity))
+		}
+	}
+
+	// blocks after handshake go in frames of negotiated version
+	l.Reader.SetVersion(version)
+	l.Writer.SetVersion(version)
+	if hello.Resumed {
+		// keys and streams go on with the resumed session
+		return nil
 	}
 
-	c.crypto = crypto.NewCrypto(passwd)
+	c2s, s2c := crypto.TrafficKeys(c.conf.Key, shared, clientHello, serverHello)
+	session, err := crypto.NewSession(cipher, c2s, s2c)
+	if err != nil {
+		return err
+	}
+	c.crypto = session
+	c.version = version
+	c.cipher = cipher
+	c.features = features
+	c.flowControl = block.Contains(c.features, block.FeatureWindow)
+	c.halfClose = block.Contains(c.features, block.FeatureHalfClose)
+	c.resend = block.Contains(c.features, block.FeatureResend)
+	c.fastConnect = c.conf.FastConnect && block.Contains(c.features, block.FeatureFastConnect)
+	c.keepAlive = block.Contains(c.features, block.FeatureKeepAlive)
+	c.multipath = block.Contains(c.features, block.FeatureMultipath) && c.flowControl && c.resend && c.halfClose
+	c.goAway = block.Contains(c.features, block.FeatureGoAway)
+	c.udp = block.Contains(c.features, block.FeatureUDP)
+	c.bind = block.Contains(c.features, block.FeatureBind)
+	if block.Contains(c.features, block.FeatureResume) && c.resend && hello.Ticket != nil {
+		c.ticket = hello.Ticket
+		c.resumeSecret = crypto.ResumeSecret(c.conf.Key, shared, clientHello, serverHello)
+	}
+	c.log = c.log.WithField("version", c.version).WithField("cipher", cipher)
+	c.log.Infof("negotiated version %v, cipher %v, features %v", c.version, cipher, c.features)
 
 	return nil
 }
 
-func (c *relay) read() {
+func (c *relay) read(l *stream.Link) {
 	c.log.Debugf("read routine start")
 	defer c.log.Debugf("read routine stop")
-	defer c.release()
+	defer c.lost(l)
 
 	for {
 		select {
-		case <-c.ctx.Done():
-			c.log.Infof("read recv done, %v", c.ctx.Err())
+		case <-l.Ctx.Done():
+			c.log.Infof("read recv done, %v", l.Ctx.Err())
 			return
 		default:
-			buf := make([]byte, block.ConstBlockHeaderSzB)
-			if n, err := io.ReadFull(c.conn, buf); err != nil || n < len(buf) {
-				c.log.Warnf("read header failed, %v", err)
-				return
+			if c.pinging() {
+				_ = l.Conn.SetReadDeadline(time.Now().Add(c.pingTimeout()))
 			}
 
-			blockData, err := block.UnMarshalHeader(buf)
-			if err != nil {
-				c.log.Errorf("broken header, %v", err)
+			blockData, err := l.Reader.Read()
+			if err == block.ErrInvalidBody && c.resend && blockData.Type == block.ConstBlockTypeData {
+				// stream asks for resend of it
+				blockData.Type = block.ConstBlockTypeInvalid
+				blockData.Data = nil
+			} else if err != nil {
+				c.log.Warnf("read block failed, %v", err)
 				return
 			}
 
-			if blockData.Length > 0 {
-				body := make([]byte, blockData.Length)
-				if n, err := io.ReadFull(c.conn, body); err != nil || n < int(blockData.Length) {
-					c.log.Warnf("read body failed, %v", err)
-					return
-				}
+			c.log.Debugf("recv block: %v", blockData)
 
-				blockData.Data = body
+			if blockData.Type == block.ConstBlockTypePing {
+				c.send(&block.BlockData{
+					Type:     block.ConstBlockTypePong,
+					BlockNum: blockData.BlockNum,
+				})
+				continue
+			} else if blockData.Type == block.ConstBlockTypePong {
+				// server is alive, read deadline is extended already
+				continue
+			} else if blockData.Type == block.ConstBlockTypeGoAway {
+				c.log.Infof("server is going away, drain streams")
+				c.drain(true)
+				continue
 			}
 
-			c.log.Debugf("recv block: %v", blockData)
-
-			c.mu.RLock()
-			if ob, ok := c.agents[blockData.ID]; ok {
-				// TODO add time out
-				ob.bus <- blockData
+			if ob, ok := c.agents.Get(blockData.ID).(*agent); ok {
+				// blocks of joined streams go on as on the relay opening it
+				blockData.ID = ob.ID
+				if blockData.Type == block.ConstBlockTypeWindowUpdate {
+					ob.window.Ack(blockData.BlockNum)
+				} else if blockData.Type == block.ConstBlockTypeRequestResend {
+					ob.resend(blockData.BlockNum)
+				} else if !ob.deliver(blockData) {
+					ob.log.Errorf("peer overruns stream window, close stream")
+					ob.cancel()
+				}
+			} else if blockData.Type == block.ConstBlockTypeRequestResend {
+				// stream is closed while its disconnect block was lost
+				c.send(&block.BlockData{
+					ID:   blockData.ID,
+					Type: block.ConstBlockTypeDisconnect,
+				})
 			}
-			c.mu.RUnlock()
 		}
 	}
 }
 
-func (c *relay) write() {
+func (c *relay) write(l *stream.Link) {
 	c.log.Debugf("write routine start")
 	defer c.log.Debugf("write routine stop")
-	defer c.release()
+	defer c.lost(l)
 
 	for {
 		select {
-		case <-c.ctx.Done():
-			c.log.Infof("write recv done, %v", c.ctx.Err())
+		case <-l.Ctx.Done():
+			c.log.Infof("write recv done, %v", l.Ctx.Err())
 			return
 		case b, ok := <-c.bus:
 			if !ok {
 				c.log.Infof("write listen closed channel")
 				return
 			}
-			if n, err := c.conn.Write(b); err != nil || n < len(b) {
+			_ = l.Conn.SetWriteDeadline(time.Now().Add(constWriteTimeoutS))
+			if err := l.Writer.Write(b); err != nil {
 				c.log.Warnf("write to remote failed, %v", err)
 				return
 			}
@@ -186,30 +483,143 @@ func (c *relay) write() {
 	}
 }
 
+// pinging reports whether relay pings server, then server must answer in time
+func (c *relay) pinging() bool {
+	return c.keepAlive && c.conf.PingInterval > 0
+}
+
+func (c *relay) pingTimeout() time.Duration {
+	if c.conf.PingTimeout > 0 {
+		return c.conf.PingTimeout
+	}
+	return constReadTimeoutS
+}
+
+func (c *relay) ping(l *stream.Link) {
+	t := time.NewTicker(c.conf.PingInterval)
+	defer t.Stop()
+
+	var seq uint32
+	for {
+		select {
+		case <-l.Ctx.Done():
+			return
+		case <-t.C:
+			seq++
+			c.send(&block.BlockData{
+				Type:     block.ConstBlockTypePing,
+				BlockNum: seq,
+			})
+		}
+	}
+}
+
+// send queues block to server, gives up once relay is closed
+func (c *relay) send(b *block.BlockData) {
+	select {
+	case c.bus <- b:
+	case <-c.ctx.Done():
+	}
+}
+
+// newStreamID returns a stream id unique in the relay,
+// leading bytes of the id are part of the block nonce
+func (c *relay) newStreamID() uuid.UUID {
+	return block.NewStreamID(atomic.AddUint32(&c.streamSeq, 1))
+}
+
 // registerAgent when receiving msgs, client will decode it and give to interested observers
 func (c *relay) registerAgent(a *agent) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	c.agents[a.ID] = a
+	if !c.agents.Add(a.ID, a) {
+		a.log.Warnf("relay is closed, drop agent")
+		a.cancel()
+	}
 }
 
 // unregisterAgent stop receive msg from client
 func (c *relay) unregisterAgent(a *agent) {
+	c.leave(a.ID)
+}
+
+// join carries blocks of agent striped over relay with stream id
+func (c *relay) join(id uuid.UUID, a *agent) {
+	c.agents.Add(id, a)
+}
+
+// leave stops carrying blocks of joined stream id
+func (c *relay) leave(id uuid.UUID) {
+	if left := c.agents.Remove(id); left == 0 && c.closingIdle() {
+		c.release()
+	}
+}
+
+// shutdown tells server relay is going away, then drains it
+func (c *relay) shutdown() {
+	if c.goAway {
+		// server closes the connection once streams are done
+		c.send(&block.BlockData{Type: block.ConstBlockTypeGoAway})
+	}
+	c.drain(!c.goAway)
+}
+
+// drain opens no more streams on relay and does not resume it,
+// if closeIdle relay is released once its streams are done
+func (c *relay) drain(closeIdle bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.closed = true
+	c.draining = true
+	c.closeIdle = c.closeIdle || closeIdle
+	// relay losing its connection is never resumed now
+	resuming := c.link == nil
+	c.mu.Unlock()
+
+	if resuming || c.agents.Len() == 0 && c.closingIdle() {
+		c.release()
+	}
+}
+
+// closingIdle reports whether relay not released yet is to be released once its streams are done
+func (c *relay) closingIdle() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.closeIdle && c.ctx.Err() == nil
+}
+
+// available reports whether relay takes new streams
+func (c *relay) available() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	delete(c.agents, a.ID)
+	return !c.closed
+}
+
+func (c *relay) isDraining() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.draining
 }
 
 // release notify observers I'm out
 func (c *relay) release() {
 	c.cancel()
-	c.conn.Close()
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.link != nil {
+		c.link.Close()
+	}
 	c.closed = true
+	c.mu.Unlock()
+
+	// streams striped over relay go on without it
+	if c.agents.Close() {
+		c.agents.Range(func(_ uuid.UUID, s interface{}) {
+			if a := s.(*agent); a.r != c {
+				a.dropPath(c)
+			}
+		})
+	}
 
 	c.log.Debugf("relay is closed")
 }
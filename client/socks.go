@@ -33,6 +33,8 @@ import (
 
 type SocksProxy struct {
 	ver byte
+	// cmd requested by socks client
+	cmd byte
 	*SocksProxyConf
 }
 
@@ -41,6 +43,11 @@ type SocksProxyConf struct {
 	Port        []byte
 	AuthType    byte
 	Credentials map[string]bool
+	// UserIDs socks4 user ids allowed, any is allowed if empty unless socks5 requires auth
+	UserIDs map[string]bool
+	// ResolveLocal resolves socks5 and socks4a domain names on client, else they are
+	// passed to server
+	ResolveLocal bool
 }
 
 const (
@@ -48,6 +55,15 @@ const (
 	SocksAuthUserName = 0x02
 )
 
+const (
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+)
+
+// socks4MaxFieldSz max length of socks4 USERID and socks4a hostname
+const socks4MaxFieldSz = 255
+
 func (p *SocksProxy) HandShake(conn net.Conn) (*block.HostData, error) {
 	ver := make([]byte, 1)
 	if n, err := io.ReadAtLeast(conn, ver, len(ver)); err != nil || n != len(ver) {
@@ -155,8 +171,10 @@ func (p *SocksProxy) socks5HandShake(conn net.Conn) (*block.HostData, error) {
 
 	var l int
 	switch req[1] {
-	case 0x01:
-		// CONNECT
+	case socksCmdConnect, socksCmdBind, socksCmdUDPAssociate:
+		// CONNECT, BIND with the peer expected to connect, or UDP ASSOCIATE with
+		// address the client sends datagrams from
+		p.cmd = req[1]
 		switch req[3] {
 		case 0x01:
 			// ipv4
@@ -168,21 +186,21 @@ func (p *SocksProxy) socks5HandShake(conn net.Conn) (*block.HostData, error) {
 				return nil, fmt.Errorf("read domain name len failed, %v", err)
 			}
 			l = int(t[0])
+			if l == 0 {
+				_, _ = conn.Write(socks5Reply(0x08))
+				return nil, fmt.Errorf("empty domain name")
+			}
 		case 0x04:
 			// ipv6
 			l = 16
 		default:
-			return nil, fmt.Errorf("unrecognized ATYP field, %v", req[1])
+			// Address type not supported
+			_, _ = conn.Write(socks5Reply(0x08))
+			return nil, fmt.Errorf("unrecognized ATYP field, %v", req[3])
 		}
-	case 0x02:
-		// BIND
-		fallthrough
-	case 0x03:
-		// UDP ASSOCIATE
-		fallthrough
 	default:
 		// Command not supported
-		_, _ = conn.Write([]byte{0x05, 0x07, 0x00})
+		_, _ = conn.Write(socks5Reply(0x07))
 		return nil, fmt.Errorf("unsupprt sock CMD, %v", req[1])
 	}
 
@@ -195,10 +213,19 @@ func (p *SocksProxy) socks5HandShake(conn net.Conn) (*block.HostData, error) {
 		return nil, fmt.Errorf("read DST.PORT failed, %v", err)
 	}
 
-	return &block.HostData{
+	host := &block.HostData{
 		Address: net.IP(addr).String(),
 		Port:    binary.BigEndian.Uint16(port),
-	}, nil
+	}
+	if req[3] == 0x03 {
+		host.Address = string(addr)
+		if err := p.resolve(host); err != nil {
+			// Host unreachable
+			_, _ = conn.Write(socks5Reply(0x04))
+			return nil, err
+		}
+	}
+	return host, nil
 }
 
 func (p *SocksProxy) socks4HandShake(conn net.Conn) (*block.HostData, error) {
@@ -206,33 +233,82 @@ func (p *SocksProxy) socks4HandShake(conn net.Conn) (*block.HostData, error) {
 	// 				| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
 	// 				+----+----+----+----+----+----+----+----+----+----+....+----+
 	// # of bytes:	   1    1      2              4           variable       1
+	//
+	// socks4a sets DSTIP to 0.0.0.x with x non-zero, then follows NULL terminated hostname
+
+	rejected := []byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 
-	// just set max length of userID up to 1024-1-2-4-1
-	// if not reach EOF, reject the request
-	buf := make([]byte, 1024)
 	// CD+DSTPORT+DSTIP = 7 bytes
-	if n, err := io.ReadAtLeast(conn, buf, 7); err != nil || n == len(buf) {
-		// userID too long
-		_, _ = conn.Write([]byte{0x00, 0x5d, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-		return nil, err
+	buf := make([]byte, 7)
+	if n, err := io.ReadAtLeast(conn, buf, len(buf)); err != nil || n != len(buf) {
+		return nil, fmt.Errorf("read req header failed, %v", err)
+	}
+	userID, err := readNullTerminated(conn)
+	if err != nil {
+		_, _ = conn.Write(rejected)
+		return nil, fmt.Errorf("read USERID failed, %v", err)
 	}
 
-	buf = buf[:7]
-
-	switch buf[0] {
-	case 0x01:
-		// CONNECT
-		return &block.HostData{
-			Address: net.IP(buf[3:7]).String(),
-			Port:    binary.BigEndian.Uint16(buf[1:3]),
-		}, nil
-	case 0x02:
-		// BIND
-		fallthrough
-	default:
-		_, _ = conn.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	if buf[0] != socksCmdConnect && buf[0] != socksCmdBind {
+		_, _ = conn.Write(rejected)
 		return nil, fmt.Errorf("unsupported cmd, %v", buf[0])
 	}
+	if (len(p.UserIDs) > 0 || p.AuthType == SocksAuthUserName) && !p.UserIDs[userID] {
+		_, _ = conn.Write(rejected)
+		return nil, fmt.Errorf("user id %q is not allowed", userID)
+	}
+	// CONNECT, or BIND with the peer expected to connect
+	p.cmd = buf[0]
+
+	host := &block.HostData{
+		Address: net.IP(buf[3:7]).String(),
+		Port:    binary.BigEndian.Uint16(buf[1:3]),
+	}
+	if buf[3] == 0 && buf[4] == 0 && buf[5] == 0 && buf[6] != 0 {
+		name, err := readNullTerminated(conn)
+		if err != nil || name == "" {
+			_, _ = conn.Write(rejected)
+			return nil, fmt.Errorf("read socks4a hostname failed, %v", err)
+		}
+		host.Address = name
+		if err := p.resolve(host); err != nil {
+			_, _ = conn.Write(rejected)
+			return nil, err
+		}
+	}
+	return host, nil
+}
+
+// readNullTerminated reads a NULL terminated socks4 field, up to socks4MaxFieldSz long
+func readNullTerminated(conn net.Conn) (string, error) {
+	// read byte by byte, data following the request is not taken
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0x00 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxFieldSz {
+			return "", fmt.Errorf("field is longer than %v", socks4MaxFieldSz)
+		}
+		field = append(field, b[0])
+	}
+}
+
+// resolve resolves domain name of host on client if ResolveLocal
+func (p *SocksProxy) resolve(host *block.HostData) error {
+	if !p.ResolveLocal {
+		return nil
+	}
+	ip, err := net.ResolveIPAddr("ip", host.Address)
+	if err != nil {
+		return fmt.Errorf("resolve %v failed, %v", host.Address, err)
+	}
+	host.Address = ip.String()
+	return nil
 }
 
 func (p *SocksProxy) HandShakeSuccess(conn net.Conn) error {
@@ -262,21 +338,149 @@ func (p *SocksProxy) HandShakeSuccess(conn net.Conn) error {
 	return nil
 }
 
-func (p *SocksProxy) HandShakeFailed(conn net.Conn) error {
+// socks5Reply returns reply of rep without bound address, as failures are replied
+func socks5Reply(rep byte) []byte {
+	return []byte{0x05, rep, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+}
+
+// socks5Reps REP of stream failed for reasons, general SOCKS server failure for others
+var socks5Reps = map[byte]byte{
+	block.ConstFailedRefused:            0x05,
+	block.ConstFailedNetworkUnreachable: 0x03,
+	block.ConstFailedHostUnreachable:    0x04,
+	block.ConstFailedDNS:                0x04,
+	block.ConstFailedTimeout:            0x06,
+	block.ConstFailedDenied:             0x02,
+}
+
+func (p *SocksProxy) HandShakeFailed(conn net.Conn, reason byte) error {
 	switch p.ver {
 	case 0x04:
+		// socks4 rejects for any reason
 		resp := []byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 		_, err := conn.Write(resp)
 		return err
 	case 0x05:
-		// Connection refused
-		resp := []byte{0x05, 0x05, 0x00}
-		_, err := conn.Write(resp)
+		rep, ok := socks5Reps[reason]
+		if !ok {
+			rep = 0x01
+		}
+		_, err := conn.Write(socks5Reply(rep))
 		return err
 	}
 	return nil
 }
 
+// associated tells socks5 client to send datagrams to addr
+func (p *SocksProxy) associated(conn net.Conn, addr *net.UDPAddr) error {
+	resp := []byte{0x05, 0x00, 0x00}
+	resp = append(resp, socksAddr(&block.HostData{Address: addr.IP.String(), Port: uint16(addr.Port)})...)
+	_, err := conn.Write(resp)
+	return err
+}
+
+// bound replies BIND twice: with the address server listens on, then with the peer
+// of the inbound connection
+func (p *SocksProxy) bound(conn net.Conn, addr *block.HostData) error {
+	var resp []byte
+	switch p.ver {
+	case 0x04:
+		resp = []byte{0x00, 0x5a, byte(addr.Port >> 8), byte(addr.Port), 0x00, 0x00, 0x00, 0x00}
+		if ip := net.ParseIP(addr.Address).To4(); ip != nil {
+			copy(resp[4:], ip)
+		}
+	case 0x05:
+		resp = append([]byte{0x05, 0x00, 0x00}, socksAddr(addr)...)
+	}
+	_, err := conn.Write(resp)
+	return err
+}
+
+// unsupported tells socks client the command is not supported
+func (p *SocksProxy) unsupported(conn net.Conn) error {
+	if p.ver == 0x04 {
+		_, err := conn.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	_, err := conn.Write(socks5Reply(0x07))
+	return err
+}
+
+// socksAddr returns ATYP, ADDR and PORT fields of socks5 address addr
+func socksAddr(addr *block.HostData) []byte {
+	var b []byte
+	if ip := net.ParseIP(addr.Address); ip == nil {
+		b = append(b, 0x03, byte(len(addr.Address)))
+		b = append(b, addr.Address...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 0x01)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, 0x04)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// parseSocksUDP returns datagram in socks5 UDP request header, fragments are not supported
+func parseSocksUDP(pkt []byte) (*block.DatagramData, error) {
+	// +----+------+------+----------+----------+----------+
+	// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	// +----+------+------+----------+----------+----------+
+	// | 2  |  1   |  1   | Variable |    2     | Variable |
+	// +----+------+------+----------+----------+----------+
+	if len(pkt) < 4 {
+		return nil, fmt.Errorf("short udp request, %v bytes", len(pkt))
+	}
+	if pkt[2] != 0x00 {
+		return nil, fmt.Errorf("fragment %v is not supported", pkt[2])
+	}
+
+	var addr string
+	var n int
+	switch pkt[3] {
+	case 0x01:
+		// ipv4
+		n = 4 + net.IPv4len
+		if len(pkt) >= n {
+			addr = net.IP(pkt[4:n]).String()
+		}
+	case 0x03:
+		// domain name
+		if len(pkt) > 4 {
+			n = 5 + int(pkt[4])
+			if len(pkt) >= n {
+				addr = string(pkt[5:n])
+			}
+		}
+	case 0x04:
+		// ipv6
+		n = 4 + net.IPv6len
+		if len(pkt) >= n {
+			addr = net.IP(pkt[4:n]).String()
+		}
+	default:
+		return nil, fmt.Errorf("unrecognized ATYP field, %v", pkt[3])
+	}
+	if addr == "" || len(pkt) < n+2 {
+		return nil, fmt.Errorf("short udp request, %v bytes", len(pkt))
+	}
+
+	return &block.DatagramData{
+		HostData: block.HostData{
+			Address: addr,
+			Port:    binary.BigEndian.Uint16(pkt[n:]),
+		},
+		Data: pkt[n+2:],
+	}, nil
+}
+
+// marshalSocksUDP puts datagram from its source in socks5 UDP request header
+func marshalSocksUDP(d *block.DatagramData) []byte {
+	pkt := append([]byte{0x00, 0x00, 0x00}, socksAddr(&d.HostData)...)
+	return append(pkt, d.Data...)
+}
+
 func (p *SocksProxy) GetProxyType() ProxyType {
 	if p.ver == 0x04 {
 		return proxySocks4
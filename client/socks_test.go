@@ -0,0 +1,222 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sunliver/shark/lib/block"
+)
+
+func TestSocksUDP(t *testing.T) {
+	cases := []block.DatagramData{
+		{HostData: block.HostData{Address: "8.8.8.8", Port: 53}, Data: []byte{0x12, 0x34}},
+		{HostData: block.HostData{Address: "2001:db8::1", Port: 443}, Data: []byte{0x56}},
+		{HostData: block.HostData{Address: "example.com", Port: 3478}, Data: []byte{}},
+	}
+
+	for _, d := range cases {
+		ud, err := parseSocksUDP(marshalSocksUDP(&d))
+		assert.Nil(t, err)
+		assert.Equal(t, d, *ud)
+	}
+
+	pkt := marshalSocksUDP(&cases[0])
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x01, 8, 8, 8, 8, 0x00, 0x35, 0x12, 0x34}, pkt)
+}
+
+func TestSocksUDPInvalid(t *testing.T) {
+	for _, pkt := range [][]byte{
+		{0x00, 0x00},
+		// fragment
+		{0x00, 0x00, 0x01, 0x01, 8, 8, 8, 8, 0x00, 0x35},
+		// unknown ATYP
+		{0x00, 0x00, 0x00, 0x02, 8, 8, 8, 8, 0x00, 0x35},
+		// short address
+		{0x00, 0x00, 0x00, 0x01, 8, 8, 8},
+		{0x00, 0x00, 0x00, 0x03, 0x05, 'a', 'b'},
+		{0x00, 0x00, 0x00, 0x03},
+		// no port
+		{0x00, 0x00, 0x00, 0x01, 8, 8, 8, 8, 0x00},
+	} {
+		_, err := parseSocksUDP(pkt)
+		assert.NotNil(t, err, "%x", pkt)
+	}
+}
+
+func TestSocksBound(t *testing.T) {
+	cases := []struct {
+		ver  byte
+		addr block.HostData
+		resp []byte
+	}{
+		{0x04, block.HostData{Address: "10.0.0.1", Port: 8080}, []byte{0x00, 0x5a, 0x1f, 0x90, 10, 0, 0, 1}},
+		{0x05, block.HostData{Address: "10.0.0.1", Port: 8080}, []byte{0x05, 0x00, 0x00, 0x01, 10, 0, 0, 1, 0x1f, 0x90}},
+		{0x05, block.HostData{Address: "::1", Port: 21}, append(append([]byte{0x05, 0x00, 0x00, 0x04}, net.IPv6loopback...), 0x00, 0x15)},
+	}
+
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		p := &SocksProxy{ver: c.ver}
+		go func() {
+			_ = p.bound(remote, &c.addr)
+			_ = remote.Close()
+		}()
+		resp, err := ioutil.ReadAll(local)
+		assert.Nil(t, err)
+		assert.Equal(t, c.resp, resp)
+	}
+}
+
+// handShake runs socks handshake of p on req, returns host data and replies to req
+func handShake(t *testing.T, p *SocksProxy, req []byte) (*block.HostData, []byte, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write(req)
+
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := p.HandShake(s)
+	_ = s.Close()
+	resp, _ := ioutil.ReadAll(conn)
+	return host, resp, err
+}
+
+func TestSocks5HandShake(t *testing.T) {
+	greet := []byte{0x05, 0x01, 0x00}
+	cases := []struct {
+		req  []byte
+		host block.HostData
+	}{
+		{[]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50}, block.HostData{Address: "10.0.0.1", Port: 80}},
+		{append(append([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb), block.HostData{Address: "2001:db8::1", Port: 443}},
+		// domain names are passed verbatim for server to resolve
+		{append(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, "example.com"...), 0x00, 0x50), block.HostData{Address: "example.com", Port: 80}},
+	}
+
+	for _, c := range cases {
+		p := &SocksProxy{SocksProxyConf: &SocksProxyConf{}}
+		host, resp, err := handShake(t, p, append(greet, c.req...))
+		assert.Nil(t, err)
+		assert.Equal(t, c.host, *host)
+		assert.Equal(t, []byte{0x05, 0x00}, resp)
+	}
+}
+
+func TestSocks5ResolveLocal(t *testing.T) {
+	req := append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 9}, "localhost"...)
+	p := &SocksProxy{SocksProxyConf: &SocksProxyConf{ResolveLocal: true}}
+	host, _, err := handShake(t, p, append(req, 0x00, 0x50))
+	assert.Nil(t, err)
+	assert.True(t, net.ParseIP(host.Address).IsLoopback(), host.Address)
+	assert.Equal(t, uint16(80), host.Port)
+
+	// unresolvable names fail with host unreachable
+	req = append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 13}, "shark.invalid"...)
+	_, resp, err := handShake(t, p, append(req, 0x00, 0x50))
+	assert.NotNil(t, err)
+	assert.Equal(t, []byte{0x05, 0x00, 0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, resp)
+}
+
+func TestSocks5HandShakeInvalid(t *testing.T) {
+	for _, req := range [][]byte{
+		// unknown ATYP
+		{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x02, 10, 0, 0, 1, 0x00, 0x50},
+		// empty domain name
+		{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 0, 0x00, 0x50},
+	} {
+		p := &SocksProxy{SocksProxyConf: &SocksProxyConf{}}
+		_, resp, err := handShake(t, p, req)
+		assert.NotNil(t, err, "%x", req)
+		assert.Equal(t, []byte{0x05, 0x00, 0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, resp, "%x", req)
+	}
+}
+
+func TestSocks4HandShake(t *testing.T) {
+	cases := []struct {
+		req  []byte
+		host block.HostData
+	}{
+		{[]byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1, 'b', 'o', 'b', 0x00}, block.HostData{Address: "10.0.0.1", Port: 80}},
+		// socks4a hostname is passed verbatim for server to resolve
+		{append([]byte{0x04, 0x01, 0x01, 0xbb, 0, 0, 0, 1, 0x00}, "example.com\x00"...), block.HostData{Address: "example.com", Port: 443}},
+	}
+
+	for _, c := range cases {
+		p := &SocksProxy{SocksProxyConf: &SocksProxyConf{}}
+		host, resp, err := handShake(t, p, c.req)
+		assert.Nil(t, err)
+		assert.Equal(t, c.host, *host)
+		assert.Empty(t, resp)
+	}
+}
+
+func TestSocks4UserID(t *testing.T) {
+	rejected := []byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	bob := []byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1, 'b', 'o', 'b', 0x00}
+	eve := []byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1, 'e', 'v', 'e', 0x00}
+
+	p := &SocksProxy{SocksProxyConf: &SocksProxyConf{UserIDs: map[string]bool{"bob": true}}}
+	_, resp, err := handShake(t, p, bob)
+	assert.Nil(t, err)
+	assert.Empty(t, resp)
+	_, resp, err = handShake(t, p, eve)
+	assert.NotNil(t, err)
+	assert.Equal(t, rejected, resp)
+
+	// socks5 auth is not bypassed by socks4 without user ids allowed
+	p = &SocksProxy{SocksProxyConf: &SocksProxyConf{AuthType: SocksAuthUserName}}
+	_, resp, err = handShake(t, p, bob)
+	assert.NotNil(t, err)
+	assert.Equal(t, rejected, resp)
+
+	// user id too long, rejected once it is read up to the limit
+	long := append([]byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1}, make([]byte, socks4MaxFieldSz+1)...)
+	for i := 8; i < len(long); i++ {
+		long[i] = 'a'
+	}
+	p = &SocksProxy{SocksProxyConf: &SocksProxyConf{}}
+	_, resp, err = handShake(t, p, long)
+	assert.NotNil(t, err)
+	assert.Equal(t, rejected, resp)
+}
+
+func TestSocksHandShakeFailed(t *testing.T) {
+	cases := []struct {
+		ver    byte
+		reason byte
+		resp   []byte
+	}{
+		{0x05, block.ConstFailedRefused, []byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{0x05, block.ConstFailedNetworkUnreachable, []byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{0x05, block.ConstFailedHostUnreachable, []byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{0x05, block.ConstFailedDNS, []byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{0x05, block.ConstFailedTimeout, []byte{0x05, 0x06, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{0x05, block.ConstFailedDenied, []byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{0x05, block.ConstFailedUnknown, []byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{0x04, block.ConstFailedRefused, []byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		p := &SocksProxy{ver: c.ver}
+		go func() {
+			_ = p.HandShakeFailed(remote, c.reason)
+			_ = remote.Close()
+		}()
+		resp, err := ioutil.ReadAll(local)
+		assert.Nil(t, err)
+		assert.Equal(t, c.resp, resp, "reason %v", c.reason)
+	}
+}
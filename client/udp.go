@@ -0,0 +1,175 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sunliver/shark/lib/block"
+)
+
+const datagramBufSz = 64 * 1024
+
+// associate serves socks5 UDP ASSOCIATE: datagrams of local client go over relay in
+// Datagram blocks until local conn is closed or server closes the association,
+// see block.FeatureUDP
+func (a *agent) associate(p *SocksProxy, hint *block.HostData) {
+	if !a.r.udp {
+		a.log.Warnf("server does not support udp associate")
+		_ = p.unsupported(a.conn)
+		return
+	}
+
+	// datagrams are taken from local client only, from the port it told if any
+	var client net.UDPAddr
+	if addr, ok := a.conn.RemoteAddr().(*net.TCPAddr); ok {
+		client.IP = addr.IP
+	}
+	if hint.Port != 0 {
+		client.Port = int(hint.Port)
+	}
+	var bind net.UDPAddr
+	if addr, ok := a.conn.LocalAddr().(*net.TCPAddr); ok {
+		bind.IP = addr.IP
+	}
+	pc, err := net.ListenUDP("udp", &bind)
+	if err != nil {
+		a.log.Errorf("listen udp failed, %v", err)
+		_ = p.HandShakeFailed(a.conn, block.ConstFailedUnknown)
+		return
+	}
+	defer pc.Close()
+
+	hintData, _ := json.Marshal(hint)
+	a.r.send(a.seal(&block.BlockData{
+		ID:   a.ID,
+		Type: block.ConstBlockTypeAssociate,
+	}, hintData))
+
+	// waiting for association opened by server
+	timeout := time.After(time.Second * 30)
+	for opened := false; !opened; {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-timeout:
+			a.log.Errorf("wait for udp associated timeout")
+			_ = p.HandShakeFailed(a.conn, block.ConstFailedTimeout)
+			return
+		case b := <-a.bus:
+			switch b.Type {
+			case block.ConstBlockTypeResume:
+			case block.ConstBlockTypeConnected:
+				opened = true
+			default:
+				a.log.Warnf("udp associate failed, %v", b)
+				_ = p.HandShakeFailed(a.conn, a.reason(b))
+				return
+			}
+		}
+	}
+	if err := p.associated(a.conn, pc.LocalAddr().(*net.UDPAddr)); err != nil {
+		a.log.Infof("handshake success failed, %v", err)
+		return
+	}
+	a.log.Infof("udp associated on %v", pc.LocalAddr())
+
+	// association lives as long as local conn
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, a.conn)
+		a.cancel()
+	}()
+	// local client is known by its first datagram
+	var peer *net.UDPAddr
+	var mu sync.Mutex
+	go a.readDatagrams(pc, &client, func(addr *net.UDPAddr) {
+		mu.Lock()
+		defer mu.Unlock()
+		peer = addr
+	})
+
+	// block num expected of next datagram block
+	var recvNum uint32
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case b := <-a.bus:
+			if b.Type == block.ConstBlockTypeDisconnect {
+				a.log.Infof("association is closed by server")
+				return
+			}
+			if b.Type != block.ConstBlockTypeDatagram || b.BlockNum < recvNum {
+				a.log.Debugf("drop block %v, expected block num %v", b, recvNum)
+				continue
+			}
+
+			d, err := a.r.crypto.Open(b.Nonce(), b.Data)
+			if err != nil {
+				a.log.Warnf("drop broken datagram block %v, %v", b, err)
+				continue
+			}
+			recvNum = b.BlockNum + 1
+			datagram, err := block.UnMarshalDatagram(d)
+			if err != nil {
+				a.log.Warnf("drop datagram block %v, %v", b, err)
+				continue
+			}
+
+			mu.Lock()
+			to := peer
+			mu.Unlock()
+			if to == nil {
+				a.log.Debugf("drop datagram, local client is not known yet")
+				continue
+			}
+			if _, err := pc.WriteToUDP(marshalSocksUDP(datagram), to); err != nil {
+				a.log.Warnf("write datagram to %v failed, %v", to, err)
+			}
+		}
+	}
+}
+
+// readDatagrams sends datagrams of local client to server,
+// datagrams from other sources are dropped
+func (a *agent) readDatagrams(pc *net.UDPConn, client *net.UDPAddr, known func(*net.UDPAddr)) {
+	defer a.cancel()
+
+	var sendNum uint32
+	buf := make([]byte, datagramBufSz)
+	for {
+		n, addr, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if a.ctx.Err() == nil {
+				a.log.Errorf("read datagram failed, %v", err)
+			}
+			return
+		}
+		if client.IP != nil && !client.IP.Equal(addr.IP) || client.Port != 0 && client.Port != addr.Port {
+			a.log.Warnf("drop datagram from unknown source %v", addr)
+			continue
+		}
+
+		datagram, err := parseSocksUDP(buf[:n])
+		if err != nil {
+			a.log.Warnf("drop datagram from %v, %v", addr, err)
+			continue
+		}
+		d, err := block.MarshalDatagram(datagram)
+		if err != nil {
+			a.log.Warnf("drop datagram to %v:%v, %v", datagram.Address, datagram.Port, err)
+			continue
+		}
+		known(addr)
+
+		a.r.send(a.seal(&block.BlockData{
+			ID:       a.ID,
+			Type:     block.ConstBlockTypeDatagram,
+			BlockNum: sendNum,
+		}, d))
+		sendNum++
+	}
+}
@@ -1,14 +1,18 @@
 package cmd
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/sunliver/shark/client"
+	"github.com/sunliver/shark/lib/crypto"
 )
 
 var claddr string
@@ -18,6 +22,20 @@ var craddr string
 var crport int
 var ccoreSz int
 var cauth string
+var csocks4Users string
+var ckey string
+var ckeyFile string
+var ccipher string
+var cciphers []string
+var cserverPubKey string
+var cuser string
+var cfastConnect bool
+var cpingInterval time.Duration
+var cpingTimeout time.Duration
+var cresumeTimeout time.Duration
+var cmultipath int
+var cdrainTimeout time.Duration
+var cresolveLocal bool
 
 func init() {
 	rootCmd.AddCommand(clientCmd)
@@ -29,12 +47,42 @@ func init() {
 	clientCmd.Flags().IntVar(&crport, "remote-port", 12306, "remote server port")
 	clientCmd.Flags().IntVar(&ccoreSz, "coresz", 4, "max num of connections with remote server")
 	clientCmd.Flags().StringVar(&cauth, "auth", "", "socks5 basic auth, RFC 1929. Format with username:passwd, separated by ;")
+	clientCmd.Flags().StringVar(&csocks4Users, "socks4-users", "", "socks4 user ids allowed, separated by ;. If empty any is allowed, unless --auth is set")
+	clientCmd.Flags().StringVar(&cuser, "user", "", "user name on server, key is the user's key then")
+	clientCmd.Flags().StringVar(&ckey, "key", "", "pre-shared key, must be the same as server's")
+	clientCmd.Flags().StringVar(&ckeyFile, "key-file", "", "file holding the pre-shared key, overrides --key")
+	clientCmd.Flags().StringSliceVar(&cciphers, "ciphers", []string{crypto.CipherChaCha20Poly1305, crypto.CipherAES256GCM}, "ciphers sealing block payloads in preference order, chacha20-poly1305, aes-256-gcm or aes-256-cbc(unauthenticated, not recommended)")
+	clientCmd.Flags().StringVar(&ccipher, "cipher", "", "cipher sealing block payloads")
+	_ = clientCmd.Flags().MarkDeprecated("cipher", "use --ciphers instead")
+	clientCmd.Flags().StringVar(&cserverPubKey, "server-pubkey", "", "pinned server identity public key, printed by shark keygen")
+	clientCmd.Flags().DurationVar(&cpingInterval, "ping-interval", time.Second*30, "interval between pings to server, 0 disables pings")
+	clientCmd.Flags().DurationVar(&cpingTimeout, "ping-timeout", time.Second*60, "replace connections to server not answering pings for so long")
+	clientCmd.Flags().DurationVar(&cresumeTimeout, "resume-timeout", time.Second*30, "resume connections to server lost for no longer than so long, 0 disables resume")
+	clientCmd.Flags().IntVar(&cmultipath, "multipath", 0, "stripe each connection over so many connections with remote server, up to coresz; 0 or 1 disables it")
+	clientCmd.Flags().DurationVar(&cdrainTimeout, "drain-timeout", time.Second*30, "on SIGINT or SIGTERM, wait so long for connections to finish before exiting")
+	clientCmd.Flags().BoolVar(&cresolveLocal, "resolve-local", false, "resolve socks5 domain names on client, by default server resolves them")
+	clientCmd.Flags().BoolVar(&cfastConnect, "fast-connect", false, "send first data along with connect to save a round trip, local apps see success before remote is connected")
 }
 
 var clientCmd = &cobra.Command{
 	Use:   "client",
 	Short: "shark client",
 	Run: func(cmd *cobra.Command, args []string) {
+		key, err := loadKey(ckey, ckeyFile)
+		if err != nil {
+			log.Panicf("start client failed, %v", err)
+		}
+		if key == nil {
+			log.Panicf("start client failed, pre-shared key is required, set --key or --key-file")
+		}
+		if ccipher != "" {
+			cciphers = []string{ccipher}
+		}
+		serverPubKey, err := loadServerPubKey(cserverPubKey)
+		if err != nil {
+			log.Panicf("start client failed, %v", err)
+		}
+
 		var sockProxyConf client.SocksProxyConf
 		if cprotocol == "socks" {
 			ip := net.ParseIP(claddr)
@@ -49,6 +97,7 @@ var clientCmd = &cobra.Command{
 			buf := make([]byte, 2)
 			binary.BigEndian.PutUint16(buf, uint16(clport))
 			sockProxyConf.Port = buf
+			sockProxyConf.ResolveLocal = cresolveLocal
 
 			if cauth != "" {
 				sockProxyConf.AuthType = client.SocksAuthUserName
@@ -59,6 +108,12 @@ var clientCmd = &cobra.Command{
 					sockProxyConf.Credentials[v] = true
 				}
 			}
+			if csocks4Users != "" {
+				sockProxyConf.UserIDs = make(map[string]bool)
+				for _, v := range strings.Split(csocks4Users, ";") {
+					sockProxyConf.UserIDs[v] = true
+				}
+			}
 		}
 
 		l, err := net.Listen("tcp", fmt.Sprintf("%v:%v", claddr, clport))
@@ -67,16 +122,35 @@ var clientCmd = &cobra.Command{
 		}
 
 		log.Infof("listen %v:%v, remote: %v:%v", claddr, clport, craddr, crport)
-		m := client.NewManager(ccoreSz, fmt.Sprintf("%v:%v", craddr, crport))
+		m := client.NewManager(ccoreSz, fmt.Sprintf("%v:%v", craddr, crport), &client.RelayConf{
+			User:          cuser,
+			Key:           key,
+			Ciphers:       cciphers,
+			ServerPubKey:  serverPubKey,
+			PingInterval:  cpingInterval,
+			PingTimeout:   cpingTimeout,
+			FastConnect:   cfastConnect,
+			ResumeTimeout: cresumeTimeout,
+			Paths:         cmultipath,
+		})
+		closeOnSignal(l, cdrainTimeout)
+
 		for {
 			conn, err := l.Accept()
-			if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			} else if err != nil {
 				log.Errorf("l get conn failed, err: %v", err)
 				continue
 			}
 
 			go m.Start(conn, NewProxy(&sockProxyConf))
 		}
+
+		drain, stop := context.WithTimeout(context.Background(), cdrainTimeout)
+		defer stop()
+		m.Shutdown(drain)
+		log.Infof("client is shut down")
 	},
 }
 
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/sunliver/shark/lib/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+// loadKey returns the pre-shared key from flag value or key file, nil if neither is set
+func loadKey(key, keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read key file failed, %v", err)
+		}
+		key = string(bytes.TrimSpace(data))
+	}
+
+	if key == "" {
+		return nil, nil
+	}
+
+	return []byte(key), nil
+}
+
+// loadIdentity returns server identity from key file generated by keygen
+func loadIdentity(identityFile string) (ed25519.PrivateKey, error) {
+	if identityFile == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("read identity file failed, %v", err)
+	}
+
+	return crypto.DecodePrivateKey(string(data))
+}
+
+// loadServerPubKey returns pinned server identity
+func loadServerPubKey(pubKey string) (ed25519.PublicKey, error) {
+	if pubKey == "" {
+		return nil, nil
+	}
+
+	return crypto.DecodePublicKey(pubKey)
+}
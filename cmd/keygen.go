@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/sunliver/shark/lib/crypto"
+)
+
+var kOut string
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+
+	keygenCmd.Flags().StringVar(&kOut, "out", "shark_identity", "identity key file, public key is written to <out>.pub")
+}
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "generate server identity key",
+	Run: func(cmd *cobra.Command, args []string) {
+		pub, priv, err := crypto.NewIdentity()
+		if err != nil {
+			log.Errorf("generate identity failed, %v", err)
+			return
+		}
+
+		if err := ioutil.WriteFile(kOut, []byte(crypto.EncodeKey(priv)+"\n"), 0600); err != nil {
+			log.Errorf("write identity failed, %v", err)
+			return
+		}
+		if err := ioutil.WriteFile(kOut+".pub", []byte(crypto.EncodeKey(pub)+"\n"), 0644); err != nil {
+			log.Errorf("write public key failed, %v", err)
+			return
+		}
+
+		fmt.Printf("identity saved to %v, start server with --identity %v\n", kOut, kOut)
+		fmt.Printf("public key: %v\n", crypto.EncodeKey(pub))
+		fmt.Printf("pin it on clients with --server-pubkey %v\n", crypto.EncodeKey(pub))
+	},
+}
@@ -2,28 +2,97 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/sunliver/shark/lib/crypto"
 	"github.com/sunliver/shark/server"
 )
 
+const (
+	usersReloadInterval = time.Second * 5
+	handShakeMaxSkew    = time.Minute * 2
+	replayCacheSz       = 64 * 1024
+)
+
 var sPort int
 var sAddr string
+var sKey string
+var sKeyFile string
+var sCiphers []string
+var sIdentity string
+var sUsers string
+var sPingInterval time.Duration
+var sPingTimeout time.Duration
+var sResumeTimeout time.Duration
+var sDrainTimeout time.Duration
+var sUDPTimeout time.Duration
+var sBindTimeout time.Duration
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
 
 	serverCmd.Flags().IntVarP(&sPort, "port", "p", 12306, "bind port")
 	serverCmd.Flags().StringVar(&sAddr, "addr", "127.0.0.1", "bind address")
+	serverCmd.Flags().StringVar(&sKey, "key", "", "pre-shared key for clients without user name, clients without it are rejected")
+	serverCmd.Flags().StringVar(&sKeyFile, "key-file", "", "file holding the pre-shared key, overrides --key")
+	serverCmd.Flags().StringSliceVar(&sCiphers, "ciphers", []string{crypto.CipherChaCha20Poly1305, crypto.CipherAES256GCM}, "allowed ciphers, aes-256-cbc is unauthenticated and disabled by default")
+	serverCmd.Flags().StringVar(&sUsers, "users", "", "json users file with per-user keys, reloaded on change: [{\"Name\": \"alice\", \"Key\": \"secret\", \"Enabled\": true}]")
+	serverCmd.Flags().StringVar(&sIdentity, "identity", "", "identity key file generated by shark keygen, clients may pin its public key")
+	serverCmd.Flags().DurationVar(&sPingInterval, "ping-interval", time.Second*30, "interval between pings to clients, 0 disables pings")
+	serverCmd.Flags().DurationVar(&sPingTimeout, "ping-timeout", time.Second*60, "close connections of clients not answering pings for so long")
+	serverCmd.Flags().DurationVar(&sResumeTimeout, "resume-timeout", time.Second*30, "keep sessions of lost connections for so long for clients to resume, 0 disables resume")
+	serverCmd.Flags().DurationVar(&sUDPTimeout, "udp-timeout", time.Second*60, "close socks5 udp associations idle for so long, 0 disables udp")
+	serverCmd.Flags().DurationVar(&sBindTimeout, "bind-timeout", time.Second*120, "close socks bind listeners without inbound connection for so long, 0 disables bind")
+	serverCmd.Flags().DurationVar(&sDrainTimeout, "drain-timeout", time.Second*30, "on SIGINT or SIGTERM, wait so long for connections to finish before exiting")
 }
 
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "shark server",
 	Run: func(cmd *cobra.Command, args []string) {
+		key, err := loadKey(sKey, sKeyFile)
+		if err != nil {
+			log.Errorf("load key failed, %v", err)
+			return
+		}
+		var users *server.Users
+		if sUsers != "" {
+			if users, err = server.LoadUsers(sUsers); err != nil {
+				log.Errorf("load users failed, %v", err)
+				return
+			}
+		}
+		if key == nil && users == nil {
+			log.Errorf("pre-shared key or users file is required, set --key, --key-file or --users")
+			return
+		}
+		identity, err := loadIdentity(sIdentity)
+		if err != nil {
+			log.Errorf("load identity failed, %v", err)
+			return
+		}
+		conf := &server.Conf{
+			Key:          key,
+			Ciphers:      sCiphers,
+			Identity:     identity,
+			Users:        users,
+			Replays:      server.NewReplayCache(handShakeMaxSkew, replayCacheSz),
+			PingInterval: sPingInterval,
+			PingTimeout:  sPingTimeout,
+			Joins:        server.NewJoins(),
+			UDPTimeout:   sUDPTimeout,
+			BindTimeout:  sBindTimeout,
+		}
+		if sResumeTimeout > 0 {
+			conf.Sessions = server.NewSessions(sResumeTimeout)
+		}
+
 		l, err := net.Listen("tcp", fmt.Sprintf("%v:%v", sAddr, sPort))
 		if err != nil {
 			log.Errorf("listen failed, %v", err)
@@ -32,16 +101,48 @@ var serverCmd = &cobra.Command{
 
 		log.Infof("now listen %v:%v", sAddr, sPort)
 
-		ctx, _ := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
+		if users != nil {
+			go users.Watch(ctx, usersReloadInterval)
+		}
+
+		closeOnSignal(l, sDrainTimeout)
+
+		// agents told to go away on shutdown, those in handshake are closed
+		var agents sync.Map
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				log.Errorf("accept failed, %v", err)
-				return
+				if !errors.Is(err, net.ErrClosed) {
+					log.Errorf("accept failed, %v", err)
+				}
+				break
 			}
 
-			go server.NewServer(ctx, conn).Run()
+			a := server.NewServer(ctx, conn, conf)
+			agents.Store(a, true)
+			go func() {
+				a.Run()
+				<-a.Done()
+				agents.Delete(a)
+			}()
 		}
+
+		drain, stop := context.WithTimeout(ctx, sDrainTimeout)
+		defer stop()
+
+		var wg sync.WaitGroup
+		agents.Range(func(k, _ interface{}) bool {
+			wg.Add(1)
+			go func(a *server.Agent) {
+				defer wg.Done()
+				a.Shutdown(drain)
+			}(k.(*server.Agent))
+			return true
+		})
+		wg.Wait()
+		log.Infof("server is shut down")
 	},
 }
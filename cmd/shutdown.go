@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// closeOnSignal closes l on SIGINT or SIGTERM to stop accepting, then connections drain
+// for so long; another signal exits at once
+func closeOnSignal(l net.Listener, drainTimeout time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		s := <-sig
+		signal.Stop(sig)
+		log.Infof("recv %v, stop accepting and drain connections for %v", s, drainTimeout)
+		_ = l.Close()
+	}()
+}
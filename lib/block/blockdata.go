@@ -12,8 +12,10 @@ import (
 
 type BlockData struct {
 	// TODO XXX change uuid.UUID to []byte
-	ID          uuid.UUID
-	Type        byte
+	ID   uuid.UUID
+	Type byte
+	// Flags only carried by v2 frames
+	Flags       byte
 	BlockNum    uint32
 	BodyCRC32   uint32
 	Length      int32
@@ -26,12 +28,43 @@ type HostData struct {
 	Port    uint16 `json:"Port"`
 }
 
+// FastConnectData carried by FastConnect block, host to connect and first data to send
+type FastConnectData struct {
+	HostData
+	Data []byte `json:"Data,omitempty"`
+}
+
 type DisconnectData []string
 
 func (b BlockData) String() string {
 	return fmt.Sprintf("%v:%v:%v:%v", fmt.Sprintf("%x", b.ID)[:8], b.Type, b.BlockNum, b.Length)
 }
 
+// Nonce returns the nonce sealing block payload,
+// built from leading bytes of stream id, block type and block num;
+// it never repeats as long as stream ids are unique in a relay and
+// block num is increasing inside a stream
+func (b *BlockData) Nonce() []byte {
+	nonce := make([]byte, ConstBlockNonceSzB)
+	copy(nonce, b.ID[:7])
+	nonce[7] = b.Type
+	binary.BigEndian.PutUint32(nonce[8:], b.BlockNum)
+	return nonce
+}
+
+// NewStreamID returns stream id of seq, a relay opens its streams with increasing seq;
+// the id carries nothing else, so v2 frames send seq only
+func NewStreamID(seq uint32) uuid.UUID {
+	var id uuid.UUID
+	binary.BigEndian.PutUint32(id[:4], seq)
+	return id
+}
+
+// StreamSeq returns seq carried by stream id
+func StreamSeq(id uuid.UUID) uint32 {
+	return binary.BigEndian.Uint32(id[:4])
+}
+
 // NewGUID returns uuid v4
 func NewGUID() uuid.UUID {
 	return uuid.NewV4()
@@ -64,3 +64,31 @@ func TestUnMarshalBroken(t *testing.T) {
 	_, err := UnMarshal(mb[:29])
 	assert.Equal(t, ErrBrokenBytes, err)
 }
+
+func TestNonce(t *testing.T) {
+	b := BlockData{
+		ID:       NewGUID(),
+		Type:     ConstBlockTypeData,
+		BlockNum: 0x12345678,
+	}
+
+	nonce := b.Nonce()
+	assert.Len(t, nonce, ConstBlockNonceSzB)
+	assert.Equal(t, b.ID[:7], nonce[:7])
+	assert.Equal(t, []byte{ConstBlockTypeData, 0x12, 0x34, 0x56, 0x78}, nonce[7:])
+
+	next := b
+	next.BlockNum++
+	assert.NotEqual(t, nonce, next.Nonce())
+
+	connect := b
+	connect.Type = ConstBlockTypeConnect
+	assert.NotEqual(t, nonce, connect.Nonce())
+}
+
+func TestStreamID(t *testing.T) {
+	assert.Equal(t, NewStreamID(1), NewStreamID(1))
+	assert.NotEqual(t, NewStreamID(1), NewStreamID(2))
+	assert.Equal(t, uint32(1), StreamSeq(NewStreamID(1)))
+	assert.Equal(t, uint32(0x12345678), StreamSeq(NewStreamID(0x12345678)))
+}
@@ -10,12 +10,75 @@ const (
 	ConstBlockTypeRequestResend     = byte(0x05)
 	ConstBlockTypeData              = byte(0x06)
 	ConstBlockTypeDisconnect        = byte(0x07)
+	ConstBlockTypeWindowUpdate      = byte(0x08)
+	ConstBlockTypeCloseWrite        = byte(0x09)
+	ConstBlockTypePing              = byte(0x0A)
+	ConstBlockTypePong              = byte(0x0B)
+	ConstBlockTypeJoin              = byte(0x0C)
+	ConstBlockTypeGoAway            = byte(0x0D)
+	ConstBlockTypeAssociate         = byte(0x0E)
+	ConstBlockTypeDatagram          = byte(0x0F)
+	ConstBlockTypeBind              = byte(0x10)
+	ConstBlockTypeBound             = byte(0x11)
 	ConstBlockTypeFastConnect       = byte(0xA0)
 	ConstBlockTypeConnectFailed     = byte(0xF0)
-	ConstBlockTypeInvalid           = byte(0xFF)
+	// ConstBlockTypeResume never goes on the wire, it is delivered to streams of
+	// a resumed session, which then ask for resend of blocks lost with the old connection
+	ConstBlockTypeResume  = byte(0xFE)
+	ConstBlockTypeInvalid = byte(0xFF)
 )
 
+var knownTypes = map[byte]bool{
+	ConstBlockTypeHandShake:         true,
+	ConstBlockTypeHandShakeResponse: true,
+	ConstBlockTypeHandShakeFinal:    true,
+	ConstBlockTypeConnect:           true,
+	ConstBlockTypeConnected:         true,
+	ConstBlockTypeRequestResend:     true,
+	ConstBlockTypeData:              true,
+	ConstBlockTypeDisconnect:        true,
+	ConstBlockTypeWindowUpdate:      true,
+	ConstBlockTypeCloseWrite:        true,
+	ConstBlockTypePing:              true,
+	ConstBlockTypePong:              true,
+	ConstBlockTypeJoin:              true,
+	ConstBlockTypeGoAway:            true,
+	ConstBlockTypeAssociate:         true,
+	ConstBlockTypeDatagram:          true,
+	ConstBlockTypeBind:              true,
+	ConstBlockTypeBound:             true,
+	ConstBlockTypeFastConnect:       true,
+	ConstBlockTypeConnectFailed:     true,
+}
+
+// reasons of ConnectFailed blocks, sealed as their one byte payload;
+// ConnectFailed without payload, e.g. of older servers, fails for unknown reason
+const (
+	ConstFailedUnknown            = byte(0x00)
+	ConstFailedRefused            = byte(0x01)
+	ConstFailedNetworkUnreachable = byte(0x02)
+	ConstFailedHostUnreachable    = byte(0x03)
+	ConstFailedDNS                = byte(0x04)
+	ConstFailedTimeout            = byte(0x05)
+	ConstFailedDenied             = byte(0x06)
+)
+
+// IsKnownType reports whether t is a valid block type on the wire
+func IsKnownType(t byte) bool {
+	return knownTypes[t]
+}
+
 // block header size
 const (
 	ConstBlockHeaderSzB = 33
 )
+
+// per block nonce size, see BlockData.Nonce
+const (
+	ConstBlockNonceSzB = 12
+)
+
+// per stream window in data blocks, see Window
+const (
+	ConstStreamWindow = 64
+)
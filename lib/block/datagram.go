@@ -0,0 +1,49 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ConstMaxDatagramSzB max size of datagram carried by a Datagram block,
+// leaving room in the block body for its address and seal
+const ConstMaxDatagramSzB = ConstMaxBodySzB - 512
+
+var ErrInvalidDatagram = errors.New("invalid datagram")
+
+// DatagramData carried by Datagram block, address is the destination of datagrams
+// from client and the source of datagrams from server
+type DatagramData struct {
+	HostData
+	Data []byte
+}
+
+// MarshalDatagram encodes d as address length, address, port and data
+func MarshalDatagram(d *DatagramData) ([]byte, error) {
+	if len(d.Address) == 0 || len(d.Address) > 255 || len(d.Data) > ConstMaxDatagramSzB {
+		return nil, ErrInvalidDatagram
+	}
+
+	buf := make([]byte, 1+len(d.Address)+2+len(d.Data))
+	buf[0] = byte(len(d.Address))
+	n := 1 + copy(buf[1:], d.Address)
+	binary.BigEndian.PutUint16(buf[n:], d.Port)
+	copy(buf[n+2:], d.Data)
+	return buf, nil
+}
+
+// UnMarshalDatagram decodes datagram encoded by MarshalDatagram
+func UnMarshalDatagram(buf []byte) (*DatagramData, error) {
+	if len(buf) < 1 || buf[0] == 0 || len(buf) < 1+int(buf[0])+2 {
+		return nil, ErrInvalidDatagram
+	}
+
+	n := 1 + int(buf[0])
+	return &DatagramData{
+		HostData: HostData{
+			Address: string(buf[1:n]),
+			Port:    binary.BigEndian.Uint16(buf[n:]),
+		},
+		Data: buf[n+2:],
+	}, nil
+}
@@ -0,0 +1,39 @@
+package block
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatagram(t *testing.T) {
+	cases := []DatagramData{
+		{HostData: HostData{Address: "8.8.8.8", Port: 53}, Data: []byte{0x12, 0x34}},
+		{HostData: HostData{Address: "example.com", Port: 443}, Data: []byte{}},
+		{HostData: HostData{Address: "::1", Port: 65535}, Data: make([]byte, ConstMaxDatagramSzB)},
+	}
+
+	for _, d := range cases {
+		buf, err := MarshalDatagram(&d)
+		assert.Nil(t, err)
+
+		ud, err := UnMarshalDatagram(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, d, *ud)
+	}
+}
+
+func TestDatagramInvalid(t *testing.T) {
+	_, err := MarshalDatagram(&DatagramData{HostData: HostData{Port: 53}})
+	assert.Equal(t, ErrInvalidDatagram, err)
+	_, err = MarshalDatagram(&DatagramData{HostData: HostData{Address: strings.Repeat("a", 256)}})
+	assert.Equal(t, ErrInvalidDatagram, err)
+	_, err = MarshalDatagram(&DatagramData{HostData: HostData{Address: "::1"}, Data: make([]byte, ConstMaxDatagramSzB+1)})
+	assert.Equal(t, ErrInvalidDatagram, err)
+
+	for _, buf := range [][]byte{nil, {0x00, 0x00, 0x35}, {0x03, 0x31, 0x2e, 0x31, 0x00}} {
+		_, err := UnMarshalDatagram(buf)
+		assert.Equal(t, ErrInvalidDatagram, err)
+	}
+}
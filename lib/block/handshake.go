@@ -0,0 +1,142 @@
+package block
+
+import "fmt"
+
+// protocol versions; peers speak the highest version both support
+const (
+	// ConstProtocolVersion1 33 bytes header with uuid stream id
+	ConstProtocolVersion1 = uint32(1)
+	// ConstProtocolVersion2 compact frame with varint stream id, see MarshalV2
+	ConstProtocolVersion2 = uint32(2)
+
+	ConstProtocolMinVersion = ConstProtocolVersion1
+	ConstProtocolMaxVersion = ConstProtocolVersion2
+)
+
+// optional protocol features
+const (
+	// FeatureWindow per stream flow control, see Window
+	FeatureWindow = "window"
+	// FeatureHalfClose CloseWrite blocks shut down one direction of a stream,
+	// BlockNum of CloseWrite is the count of data blocks sent before
+	FeatureHalfClose = "half-close"
+	// FeatureResend a stream receiving a broken data block asks for resend
+	// with RequestResend, see Retransmit
+	FeatureResend = "resend"
+	// FeatureFastConnect FastConnect blocks open streams with first data,
+	// clients use it only if asked to
+	FeatureFastConnect = "fast-connect"
+	// FeatureKeepAlive Ping blocks of nil stream id are answered by Pong blocks
+	// with the same BlockNum, so peers detect dead relays
+	FeatureKeepAlive = "keepalive"
+	// FeatureResume server issues a ticket in its hello; a client losing the connection
+	// offers the ticket on a new one and proves to hold the session's resume secret,
+	// then the session goes on with its streams, keys and stream ids; streams ask for
+	// blocks lost with the old connection as with FeatureResend, which it relies on
+	FeatureResume = "resume"
+	// FeatureMultipath server answers Connected with a token sealed in its data, other
+	// relays of the client join the stream by Join blocks carrying the token; data blocks
+	// of the stream then go over any of them, sealed as on the relay opening the stream,
+	// see Reorder. Clients use it only if asked to, it relies on window, resend and half-close
+	FeatureMultipath = "multipath"
+	// FeatureGoAway a peer shutting down sends GoAway of nil stream id; the other peer
+	// opens no more streams on the connection and does not resume it, while streams
+	// opened before go on until they are done or the sender closes the connection
+	FeatureGoAway = "goaway"
+	// FeatureUDP Associate blocks open UDP associations, answered by Connected or
+	// ConnectFailed; Datagram blocks then carry a datagram each, see DatagramData,
+	// with BlockNum increasing in each direction; blocks behind are dropped, not resent.
+	// Either peer closes the association by Disconnect, server does once it is idle
+	FeatureUDP = "udp"
+	// FeatureBind Bind blocks open streams carrying an inbound connection to the server:
+	// server answers by Bound carrying the address it listens on, then by Connected
+	// carrying the address of the inbound connection, or by ConnectFailed
+	FeatureBind = "bind"
+)
+
+// Features optional protocol features supported by this build,
+// peers enable those both offer
+var Features = []string{FeatureWindow, FeatureHalfClose, FeatureResend, FeatureFastConnect, FeatureKeepAlive, FeatureResume, FeatureMultipath, FeatureGoAway, FeatureUDP, FeatureBind}
+
+// HandShakeData carried by handshake blocks
+type HandShakeData struct {
+	// Version client offers its max version, server answers the chosen one
+	Version uint32 `json:"Version,omitempty"`
+	// User client account name, empty for the server shared key
+	User  string `json:"User,omitempty"`
+	Nonce []byte `json:"Nonce,omitempty"`
+	// Timestamp unix seconds when client starts handshake
+	Timestamp int64 `json:"Timestamp,omitempty"`
+	// PublicKey ephemeral x25519 public key
+	PublicKey []byte `json:"PublicKey,omitempty"`
+	// Cipher chosen by server; older clients offer their only cipher here
+	Cipher string `json:"Cipher,omitempty"`
+	// Ciphers offered by client, in preference order
+	Ciphers []string `json:"Ciphers,omitempty"`
+	// Features client offers, server answers the enabled ones
+	Features  []string `json:"Features,omitempty"`
+	Proof     []byte   `json:"Proof,omitempty"`
+	Identity  []byte   `json:"Identity,omitempty"`
+	Signature []byte   `json:"Signature,omitempty"`
+	// Ticket client offers ticket of session to resume, server answers ticket of the session
+	Ticket []byte `json:"Ticket,omitempty"`
+	// Resumed server goes on with session of the offered ticket
+	Resumed bool `json:"Resumed,omitempty"`
+	// ResumeProof client proves to hold resume secret of the session
+	ResumeProof []byte `json:"ResumeProof,omitempty"`
+}
+
+// OfferedCiphers returns ciphers offered by client in preference order
+func (h *HandShakeData) OfferedCiphers() []string {
+	if len(h.Ciphers) == 0 && h.Cipher != "" {
+		return []string{h.Cipher}
+	}
+	return h.Ciphers
+}
+
+// SelectVersion returns the version to speak with a peer offering max version offered
+func SelectVersion(offered uint32) (uint32, error) {
+	if offered == 0 {
+		// peers before versioning speak version 1
+		offered = ConstProtocolVersion1
+	}
+	if offered < ConstProtocolMinVersion {
+		return 0, fmt.Errorf("protocol version %v is too old, need %v at least", offered, ConstProtocolMinVersion)
+	}
+	if offered > ConstProtocolMaxVersion {
+		return ConstProtocolMaxVersion, nil
+	}
+	return offered, nil
+}
+
+// Select returns offered items which are supported, keeping offered order
+func Select(offered, supported []string) []string {
+	selected := make([]string, 0, len(offered))
+	for _, o := range offered {
+		if Contains(supported, o) && !Contains(selected, o) {
+			selected = append(selected, o)
+		}
+	}
+	return selected
+}
+
+// Without returns items of list except item
+func Without(list []string, item string) []string {
+	rest := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != item {
+			rest = append(rest, v)
+		}
+	}
+	return rest
+}
+
+// Contains reports whether item is in list
+func Contains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
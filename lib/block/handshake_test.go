@@ -0,0 +1,41 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectVersion(t *testing.T) {
+	v, err := SelectVersion(0)
+	assert.Nil(t, err)
+	assert.Equal(t, ConstProtocolVersion1, v)
+
+	v, err = SelectVersion(ConstProtocolMaxVersion + 1)
+	assert.Nil(t, err)
+	assert.Equal(t, ConstProtocolMaxVersion, v)
+
+	v, err = SelectVersion(ConstProtocolMinVersion)
+	assert.Nil(t, err)
+	assert.Equal(t, ConstProtocolMinVersion, v)
+}
+
+func TestSelect(t *testing.T) {
+	assert.Equal(t, []string{"b", "a"}, Select([]string{"b", "c", "a", "b"}, []string{"a", "b"}))
+	assert.Equal(t, []string{}, Select(nil, []string{"a"}))
+	assert.Equal(t, []string{}, Select([]string{"a"}, nil))
+}
+
+func TestWithout(t *testing.T) {
+	assert.Equal(t, []string{"a", "c"}, Without([]string{"a", "b", "c", "b"}, "b"))
+	assert.Equal(t, []string{"a"}, Without([]string{"a"}, "b"))
+	assert.Equal(t, []string{}, Without(nil, "a"))
+}
+
+func TestOfferedCiphers(t *testing.T) {
+	h := HandShakeData{Cipher: "a"}
+	assert.Equal(t, []string{"a"}, h.OfferedCiphers())
+
+	h = HandShakeData{Ciphers: []string{"b", "a"}}
+	assert.Equal(t, []string{"b", "a"}, h.OfferedCiphers())
+}
@@ -0,0 +1,99 @@
+package block
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// default max body size of a block
+const (
+	ConstMaxBodySzB = 64 * 1024
+)
+
+var (
+	ErrInvalidLength = errors.New("data: invalid body length")
+	ErrInvalidType   = errors.New("data: unknown block type")
+	ErrInvalidBody   = errors.New("data: broken body")
+)
+
+// Reader reads blocks from a stream one by one, it checks every header before
+// trusting it, so a bogus header can't make it allocate a huge body
+type Reader struct {
+	r         *bufio.Reader
+	maxBodySz int
+	version   uint32
+	header    []byte
+}
+
+// NewReader init reader accepting bodies up to maxBodySz, 0 for ConstMaxBodySzB
+func NewReader(r io.Reader, maxBodySz int) *Reader {
+	if maxBodySz <= 0 {
+		maxBodySz = ConstMaxBodySzB
+	}
+
+	return &Reader{
+		r:         bufio.NewReader(r),
+		maxBodySz: maxBodySz,
+		version:   ConstProtocolVersion1,
+		header:    make([]byte, ConstBlockHeaderSzB),
+	}
+}
+
+// SetVersion switches frame format once handshake is done
+func (r *Reader) SetVersion(version uint32) {
+	r.version = version
+}
+
+// Read reads next block.
+// It returns ErrInvalidBlock for broken header, ErrInvalidLength for negative or
+// too large body, ErrInvalidType for unknown block type; the stream can't be read
+// any more after those. It returns the block together with ErrInvalidBody if only
+// body is broken, the stream is still in sync then.
+// Errors from underlying reader are returned as is.
+func (r *Reader) Read() (*BlockData, error) {
+	var blockData *BlockData
+	var err error
+	if r.version >= ConstProtocolVersion2 {
+		blockData, err = readHeaderV2(r.r)
+	} else {
+		blockData, err = r.readHeader()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if blockData.Length < 0 || int(blockData.Length) > r.maxBodySz {
+		return nil, ErrInvalidLength
+	}
+
+	if !IsKnownType(blockData.Type) {
+		return nil, ErrInvalidType
+	}
+
+	if blockData.Length > 0 {
+		body := make([]byte, blockData.Length)
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		blockData.Data = body
+
+		if blockData.BodyCRC32 != crc32.ChecksumIEEE(body) {
+			return blockData, ErrInvalidBody
+		}
+	}
+
+	return blockData, nil
+}
+
+func (r *Reader) readHeader() (*BlockData, error) {
+	if _, err := io.ReadFull(r.r, r.header); err != nil {
+		return nil, err
+	}
+
+	return UnMarshalHeader(r.header)
+}
@@ -0,0 +1,106 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// header with a valid header crc
+func forgeHeader(t byte, length int32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, NewGUID())
+	binary.Write(buf, binary.LittleEndian, t)
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	binary.Write(buf, binary.LittleEndian, length)
+	binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	cases := []BlockData{
+		{
+			ID:       NewGUID(),
+			Type:     ConstBlockTypeData,
+			BlockNum: 0x12345678,
+			Data:     []byte{0x12, 0x34, 0x56, 0x78},
+		},
+		{
+			ID:   NewGUID(),
+			Type: ConstBlockTypeHandShake,
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	for i := range cases {
+		buf.Write(Marshal(&cases[i]))
+	}
+
+	r := NewReader(buf, 0)
+	for _, b := range cases {
+		rb, err := r.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, b.ID, rb.ID)
+		assert.Equal(t, b.Type, rb.Type)
+		assert.Equal(t, b.BlockNum, rb.BlockNum)
+		assert.Equal(t, b.Data, rb.Data)
+	}
+
+	_, err := r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderInvalid(t *testing.T) {
+	// huge length
+	_, err := NewReader(bytes.NewReader(forgeHeader(ConstBlockTypeData, 0x7fffffff)), 0).Read()
+	assert.Equal(t, ErrInvalidLength, err)
+
+	// negative length
+	_, err = NewReader(bytes.NewReader(forgeHeader(ConstBlockTypeData, -1)), 0).Read()
+	assert.Equal(t, ErrInvalidLength, err)
+
+	// configurable max body
+	_, err = NewReader(bytes.NewReader(forgeHeader(ConstBlockTypeData, 1025)), 1024).Read()
+	assert.Equal(t, ErrInvalidLength, err)
+
+	// unknown type
+	_, err = NewReader(bytes.NewReader(forgeHeader(0x7f, 0)), 0).Read()
+	assert.Equal(t, ErrInvalidType, err)
+
+	// broken header
+	mb := Marshal(&BlockData{ID: NewGUID(), Type: ConstBlockTypeData})
+	mb[16] = 0xff
+	_, err = NewReader(bytes.NewReader(mb), 0).Read()
+	assert.Equal(t, ErrInvalidBlock, err)
+
+	// truncated body
+	mb = Marshal(&BlockData{ID: NewGUID(), Type: ConstBlockTypeData, Data: []byte{0x12, 0x34}})
+	_, err = NewReader(bytes.NewReader(mb[:len(mb)-1]), 0).Read()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderInvalidBody(t *testing.T) {
+	b := BlockData{ID: NewGUID(), Type: ConstBlockTypeData, BlockNum: 3, Data: []byte{0x12, 0x34}}
+	next := BlockData{ID: NewGUID(), Type: ConstBlockTypeData, BlockNum: 4}
+
+	mb := Marshal(&b)
+	mb[len(mb)-1] ^= 0xff
+	buf := bytes.NewBuffer(mb)
+	buf.Write(Marshal(&next))
+
+	r := NewReader(buf, 0)
+	rb, err := r.Read()
+	assert.Equal(t, ErrInvalidBody, err)
+	assert.Equal(t, b.ID, rb.ID)
+	assert.Equal(t, b.BlockNum, rb.BlockNum)
+
+	// stream is still in sync
+	rb, err = r.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, next.ID, rb.ID)
+}
@@ -0,0 +1,68 @@
+package block
+
+import "sync"
+
+// Reorder puts data blocks of a stream striped over several relays back in BlockNum
+// order, with the CloseWrite block ending them. Blocks ahead are held until the missing
+// ones arrive; as the window bounds blocks in flight, at most ConstStreamWindow are held.
+// Invalid blocks take the place of the broken data block, so the stream asks for resend
+// once it gets there. Blocks behind and other blocks pass at once.
+type Reorder struct {
+	mu      sync.Mutex
+	next    uint32
+	pending map[uint32]*BlockData
+	close   *BlockData
+}
+
+// NewReorder init reorder buffer of a new stream
+func NewReorder() *Reorder {
+	return &Reorder{
+		pending: make(map[uint32]*BlockData),
+	}
+}
+
+// Push passes b on by pass in order, with blocks held behind it; it returns false
+// if pass does, or b is too far ahead
+func (r *Reorder) Push(b *BlockData, pass func(*BlockData) bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ahead := b.BlockNum - r.next
+	if b.Type == ConstBlockTypeCloseWrite && ahead != 0 && ahead < 1<<31 {
+		r.close = b
+		return true
+	}
+	if b.Type != ConstBlockTypeData && b.Type != ConstBlockTypeInvalid || ahead >= 1<<31 {
+		return pass(b)
+	}
+	if ahead >= ConstStreamWindow {
+		return false
+	}
+	if ahead > 0 {
+		r.pending[b.BlockNum] = b
+		return true
+	}
+
+	for {
+		if !pass(b) {
+			return false
+		}
+		if b.Type == ConstBlockTypeInvalid {
+			// wait for resend of it
+			return true
+		}
+		delete(r.pending, r.next)
+		r.next++
+
+		var ok bool
+		if b, ok = r.pending[r.next]; !ok {
+			break
+		}
+	}
+
+	if r.close != nil && r.close.BlockNum == r.next {
+		b, r.close = r.close, nil
+		return pass(b)
+	}
+	return true
+}
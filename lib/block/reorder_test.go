@@ -0,0 +1,57 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReorder(t *testing.T) {
+	r := NewReorder()
+	var passed []uint32
+	pass := func(b *BlockData) bool {
+		passed = append(passed, b.BlockNum)
+		return true
+	}
+	data := func(num uint32) *BlockData {
+		return &BlockData{Type: ConstBlockTypeData, BlockNum: num}
+	}
+
+	// ahead blocks wait for missing ones
+	assert.True(t, r.Push(data(1), pass))
+	assert.True(t, r.Push(&BlockData{Type: ConstBlockTypeCloseWrite, BlockNum: 3}, pass))
+	assert.True(t, r.Push(data(2), pass))
+	assert.Empty(t, passed)
+	assert.True(t, r.Push(data(0), pass))
+	assert.Equal(t, []uint32{0, 1, 2, 3}, passed)
+
+	// duplicates and control blocks pass at once
+	passed = nil
+	assert.True(t, r.Push(data(1), pass))
+	assert.True(t, r.Push(&BlockData{Type: ConstBlockTypeWindowUpdate, BlockNum: 9}, pass))
+	assert.Equal(t, []uint32{1, 9}, passed)
+
+	// too far ahead
+	assert.False(t, r.Push(data(3+ConstStreamWindow), pass))
+}
+
+func TestReorderInvalid(t *testing.T) {
+	r := NewReorder()
+	var passed []*BlockData
+	pass := func(b *BlockData) bool {
+		passed = append(passed, b)
+		return true
+	}
+
+	// broken block ahead is passed once stream gets there, then resent block goes on
+	assert.True(t, r.Push(&BlockData{Type: ConstBlockTypeData, BlockNum: 2}, pass))
+	assert.True(t, r.Push(&BlockData{Type: ConstBlockTypeInvalid, BlockNum: 1}, pass))
+	assert.True(t, r.Push(&BlockData{Type: ConstBlockTypeData, BlockNum: 0}, pass))
+	assert.Len(t, passed, 2)
+	assert.Equal(t, ConstBlockTypeInvalid, passed[1].Type)
+
+	passed = nil
+	assert.True(t, r.Push(&BlockData{Type: ConstBlockTypeData, BlockNum: 1}, pass))
+	assert.Len(t, passed, 2)
+	assert.Equal(t, uint32(2), passed[1].BlockNum)
+}
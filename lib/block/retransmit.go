@@ -0,0 +1,58 @@
+package block
+
+import "sync"
+
+// Retransmit keeps the last ConstStreamWindow data blocks sent on a stream,
+// with the CloseWrite block ending it if any. On RequestResend the sender goes
+// back to the requested BlockNum and sends everything from there again, the
+// receiver drops blocks out of sequence until the requested one arrives.
+// With flow control every block not consumed by receiver is still kept.
+type Retransmit struct {
+	mu     sync.Mutex
+	blocks []*BlockData
+	// next block num of data block
+	next  uint32
+	close *BlockData
+}
+
+// NewRetransmit init retransmit buffer of a new stream
+func NewRetransmit() *Retransmit {
+	return &Retransmit{
+		blocks: make([]*BlockData, ConstStreamWindow),
+	}
+}
+
+// Send keeps data block and queues it by send,
+// blocks are queued in order even if a resend is going on
+func (r *Retransmit) Send(b *BlockData, send func(*BlockData)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b.Type == ConstBlockTypeCloseWrite {
+		r.close = b
+	} else {
+		r.blocks[b.BlockNum%ConstStreamWindow] = b
+		r.next = b.BlockNum + 1
+	}
+	send(b)
+}
+
+// Resend queues kept blocks from data block num by send,
+// it returns false if block num is not kept any more
+func (r *Retransmit) Resend(num uint32, send func(*BlockData)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next - num
+	if n > ConstStreamWindow || n > r.next {
+		return false
+	}
+
+	for i := num; i != r.next; i++ {
+		send(r.blocks[i%ConstStreamWindow])
+	}
+	if r.close != nil {
+		send(r.close)
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetransmit(t *testing.T) {
+	r := NewRetransmit()
+	var sent []uint32
+	send := func(b *BlockData) {
+		sent = append(sent, b.BlockNum)
+	}
+
+	for i := uint32(0); i < ConstStreamWindow+2; i++ {
+		r.Send(&BlockData{Type: ConstBlockTypeData, BlockNum: i}, send)
+	}
+	assert.Len(t, sent, ConstStreamWindow+2)
+
+	// go back to block num
+	sent = nil
+	assert.True(t, r.Resend(ConstStreamWindow, send))
+	assert.Equal(t, []uint32{ConstStreamWindow, ConstStreamWindow + 1}, sent)
+
+	// nothing to resend
+	sent = nil
+	assert.True(t, r.Resend(ConstStreamWindow+2, send))
+	assert.Empty(t, sent)
+
+	// dropped or never sent
+	assert.False(t, r.Resend(1, send))
+	assert.False(t, r.Resend(ConstStreamWindow+3, send))
+
+	// close write goes last
+	r.Send(&BlockData{Type: ConstBlockTypeCloseWrite, BlockNum: ConstStreamWindow + 2}, send)
+	sent = nil
+	assert.True(t, r.Resend(ConstStreamWindow+1, send))
+	assert.Equal(t, []uint32{ConstStreamWindow + 1, ConstStreamWindow + 2}, sent)
+}
+
+func TestRetransmitEarly(t *testing.T) {
+	r := NewRetransmit()
+	send := func(b *BlockData) {}
+
+	assert.True(t, r.Resend(0, send))
+	r.Send(&BlockData{Type: ConstBlockTypeData, BlockNum: 0}, send)
+	assert.True(t, r.Resend(0, send))
+	assert.False(t, r.Resend(2, send))
+}
@@ -0,0 +1,154 @@
+package block
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// v2 frame, spoken after handshake when protocol version 2 is negotiated;
+// handshake blocks are always v1 frames
+//
+// +-----------------+------+---------+-----------+--------+-----------+-----------+----------+
+// | STREAM<<1|FLAG  | TYPE | [FLAGS] | BLOCK NUM | LENGTH | [BODYCRC] | HEADERCRC |   BODY   |
+// +-----------------+------+---------+-----------+--------+-----------+-----------+----------+
+// |     uvarint     |  1   |    1    |  uvarint  | uvarint|     4     |     4     | Variable |
+// +-----------------+------+---------+-----------+--------+-----------+-----------+----------+
+//
+// STREAM is StreamSeq of block id, the lowest bit tells whether FLAGS follows TYPE,
+// BODYCRC only exists with non-empty body. Stream ids of v2 carry nothing but seq,
+// see NewStreamID.
+
+// max v2 header size
+const (
+	ConstBlockHeaderV2MaxSzB = binary.MaxVarintLen32*3 + 1 + 1 + 4 + 4
+)
+
+// MarshalV2 blockdata into v2 frame
+func MarshalV2(b *BlockData) []byte {
+	if b == nil {
+		return nil
+	}
+	b.Length = int32(len(b.Data))
+	b.BodyCRC32 = crc32.ChecksumIEEE(b.Data)
+
+	buf := make([]byte, 0, ConstBlockHeaderV2MaxSzB+len(b.Data))
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	stream := uint64(StreamSeq(b.ID)) << 1
+	if b.Flags != 0 {
+		stream |= 1
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, stream)]...)
+	buf = append(buf, b.Type)
+	if b.Flags != 0 {
+		buf = append(buf, b.Flags)
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(b.BlockNum))]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(b.Length))]...)
+	if b.Length > 0 {
+		binary.LittleEndian.PutUint32(tmp, b.BodyCRC32)
+		buf = append(buf, tmp[:4]...)
+	}
+	b.HeaderCRC32 = crc32.ChecksumIEEE(buf)
+	binary.LittleEndian.PutUint32(tmp, b.HeaderCRC32)
+	buf = append(buf, tmp[:4]...)
+
+	return append(buf, b.Data...)
+}
+
+// headerReader records every header byte read, for header crc
+type headerReader struct {
+	r   io.ByteReader
+	buf []byte
+}
+
+func (h *headerReader) ReadByte() (byte, error) {
+	c, err := h.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	h.buf = append(h.buf, c)
+	return c, nil
+}
+
+func (h *headerReader) uvarint32() (uint32, error) {
+	v, err := binary.ReadUvarint(h)
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxUint32 {
+		return 0, ErrInvalidBlock
+	}
+	return uint32(v), nil
+}
+
+func (h *headerReader) uint32() (uint32, error) {
+	b := make([]byte, 4)
+	for i := range b {
+		c, err := h.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		b[i] = c
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// readHeaderV2 reads v2 header; io.EOF only if stream ends before the frame
+func readHeaderV2(r io.ByteReader) (*BlockData, error) {
+	h := &headerReader{r: r, buf: make([]byte, 0, ConstBlockHeaderV2MaxSzB)}
+	blockData := &BlockData{}
+
+	stream, err := h.uvarint32()
+	if err != nil {
+		if err == io.EOF && len(h.buf) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	blockData.ID = NewStreamID(stream >> 1)
+
+	if blockData.Type, err = h.ReadByte(); err != nil {
+		return nil, unexpected(err)
+	}
+	if stream&1 != 0 {
+		if blockData.Flags, err = h.ReadByte(); err != nil {
+			return nil, unexpected(err)
+		}
+	}
+	if blockData.BlockNum, err = h.uvarint32(); err != nil {
+		return nil, unexpected(err)
+	}
+	length, err := h.uvarint32()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if length > math.MaxInt32 {
+		return nil, ErrInvalidLength
+	}
+	blockData.Length = int32(length)
+	if blockData.Length > 0 {
+		if blockData.BodyCRC32, err = h.uint32(); err != nil {
+			return nil, unexpected(err)
+		}
+	}
+
+	crc := crc32.ChecksumIEEE(h.buf)
+	if blockData.HeaderCRC32, err = h.uint32(); err != nil {
+		return nil, unexpected(err)
+	}
+	if blockData.HeaderCRC32 != crc {
+		return nil, ErrInvalidBlock
+	}
+
+	return blockData, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package block
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalV2(t *testing.T) {
+	cases := []BlockData{
+		{
+			ID:       NewStreamID(1),
+			Type:     ConstBlockTypeData,
+			BlockNum: 0x12345678,
+			Data:     []byte{0x12, 0x34, 0x56, 0x78},
+		},
+		{
+			ID:   NewStreamID(0x7fffffff),
+			Type: ConstBlockTypeConnected,
+		},
+		{
+			ID:    NewStreamID(300),
+			Type:  ConstBlockTypeData,
+			Flags: 0x01,
+			Data:  bytes.Repeat([]byte{0xff}, 4096),
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	w.SetVersion(ConstProtocolVersion2)
+	for i := range cases {
+		assert.Nil(t, w.Write(&cases[i]))
+	}
+
+	r := NewReader(buf, 0)
+	r.SetVersion(ConstProtocolVersion2)
+	for _, b := range cases {
+		rb, err := r.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, b.ID, rb.ID)
+		assert.Equal(t, b.Type, rb.Type)
+		assert.Equal(t, b.Flags, rb.Flags)
+		assert.Equal(t, b.BlockNum, rb.BlockNum)
+		assert.Equal(t, b.Data, rb.Data)
+	}
+
+	_, err := r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMarshalV2Compact(t *testing.T) {
+	b := BlockData{
+		ID:       NewStreamID(5),
+		Type:     ConstBlockTypeData,
+		BlockNum: 100,
+		Data:     []byte{0x12},
+	}
+
+	// stream, type, block num, length, body crc, header crc
+	assert.Len(t, MarshalV2(&b), 1+1+1+1+4+4+1)
+	assert.Len(t, Marshal(&b), ConstBlockHeaderSzB+1)
+}
+
+func TestReaderV2Invalid(t *testing.T) {
+	b := BlockData{ID: NewStreamID(1), Type: ConstBlockTypeData, Data: []byte{0x12, 0x34}}
+
+	// broken header
+	mb := MarshalV2(&b)
+	mb[1] = ConstBlockTypeConnect
+	r := NewReader(bytes.NewReader(mb), 0)
+	r.SetVersion(ConstProtocolVersion2)
+	_, err := r.Read()
+	assert.Equal(t, ErrInvalidBlock, err)
+
+	// broken body
+	mb = MarshalV2(&b)
+	mb[len(mb)-1] ^= 0xff
+	r = NewReader(bytes.NewReader(mb), 0)
+	r.SetVersion(ConstProtocolVersion2)
+	_, err = r.Read()
+	assert.Equal(t, ErrInvalidBody, err)
+
+	// truncated header
+	mb = MarshalV2(&b)
+	r = NewReader(bytes.NewReader(mb[:3]), 0)
+	r.SetVersion(ConstProtocolVersion2)
+	_, err = r.Read()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// too large body
+	mb = MarshalV2(&BlockData{ID: NewStreamID(1), Type: ConstBlockTypeData, Data: make([]byte, 2048)})
+	r = NewReader(bytes.NewReader(mb), 1024)
+	r.SetVersion(ConstProtocolVersion2)
+	_, err = r.Read()
+	assert.Equal(t, ErrInvalidLength, err)
+}
@@ -0,0 +1,62 @@
+package block
+
+import (
+	"context"
+	"sync"
+)
+
+// Window holds send credits of a stream. The receiver acks data blocks it consumed
+// with WindowUpdate blocks carrying the count in BlockNum, the sender keeps at most
+// ConstStreamWindow data blocks unacked, so a slow stream never stalls the others
+type Window struct {
+	mu     sync.Mutex
+	acked  uint32
+	update chan struct{}
+}
+
+// NewWindow init window of a new stream
+func NewWindow() *Window {
+	return &Window{
+		update: make(chan struct{}, 1),
+	}
+}
+
+// Wait blocks until data block num fits in window, or ctx is done
+func (w *Window) Wait(ctx context.Context, num uint32) error {
+	for {
+		w.mu.Lock()
+		fits := num-w.acked < ConstStreamWindow
+		w.mu.Unlock()
+		if fits {
+			return nil
+		}
+
+		select {
+		case <-w.update:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Ack records peer consumed data blocks before num, stale acks are ignored
+func (w *Window) Ack(num uint32) {
+	w.mu.Lock()
+	if num-w.acked < 1<<31 {
+		w.acked = num
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.update <- struct{}{}:
+	default:
+	}
+}
+
+// Acked returns count of data blocks peer consumed
+func (w *Window) Acked() uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.acked
+}
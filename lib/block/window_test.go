@@ -0,0 +1,48 @@
+package block
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindow(t *testing.T) {
+	w := NewWindow()
+	ctx := context.Background()
+
+	for i := uint32(0); i < ConstStreamWindow; i++ {
+		assert.Nil(t, w.Wait(ctx, i))
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- w.Wait(ctx, ConstStreamWindow)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("wait beyond window")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	w.Ack(1)
+	assert.Nil(t, <-done)
+
+	// stale ack
+	w.Ack(0)
+	assert.Nil(t, w.Wait(ctx, ConstStreamWindow))
+	assert.Equal(t, uint32(1), w.Acked())
+}
+
+func TestWindowCancel(t *testing.T) {
+	w := NewWindow()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, w.Wait(ctx, ConstStreamWindow))
+}
@@ -0,0 +1,35 @@
+package block
+
+import "io"
+
+// Writer writes blocks in frame of the negotiated version
+type Writer struct {
+	w       io.Writer
+	version uint32
+}
+
+// NewWriter init writer speaking v1 frames, as handshake does
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:       w,
+		version: ConstProtocolVersion1,
+	}
+}
+
+// SetVersion switches frame format once handshake is done
+func (w *Writer) SetVersion(version uint32) {
+	w.version = version
+}
+
+// Write marshals and writes a block
+func (w *Writer) Write(b *BlockData) error {
+	var buf []byte
+	if w.version >= ConstProtocolVersion2 {
+		buf = MarshalV2(b)
+	} else {
+		buf = Marshal(b)
+	}
+
+	_, err := w.w.Write(buf)
+	return err
+}
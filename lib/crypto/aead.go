@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// AEAD authenticated encryption with a caller supplied nonce for each block
+type AEAD struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCM returns aes gcm cipher, key must be 32 bytes
+func NewAESGCM(key []byte) (*AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AEAD{aead: aead}, nil
+}
+
+// NewChaCha20Poly1305 returns chacha20-poly1305 cipher, key must be 32 bytes
+func NewChaCha20Poly1305(key []byte) (*AEAD, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AEAD{aead: aead}, nil
+}
+
+func (c *AEAD) Seal(nonce, plaintext []byte) []byte {
+	return c.aead.Seal(nil, nonce, plaintext, nil)
+}
+
+func (c *AEAD) Open(nonce, ciphertext []byte) ([]byte, error) {
+	if len(nonce) != c.aead.NonceSize() {
+		return nil, ErrAuthFailed
+	}
+
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCipher(t *testing.T) {
+	key := make([]byte, 32)
+	nonce := make([]byte, 12)
+
+	texts := []string{
+		"Hello Crypt",
+		"Hello\r\n",
+		"moremoremoremoremoremoremoremoremoremoremore",
+	}
+
+	for _, name := range []string{CipherAES256CBC, CipherAES256GCM, CipherChaCha20Poly1305} {
+		c, err := NewCipher(name, key)
+		assert.Nil(t, err)
+
+		for _, text := range texts {
+			sealed := c.Seal(nonce, []byte(text))
+			opened, err := c.Open(nonce, sealed)
+			assert.Nil(t, err, name)
+			assert.Equal(t, text, string(opened), name)
+		}
+	}
+
+	_, err := NewCipher("rot13", key)
+	assert.NotNil(t, err)
+}
+
+func TestAEADTampered(t *testing.T) {
+	key := make([]byte, 32)
+	nonce := make([]byte, 12)
+
+	for _, name := range []string{CipherAES256GCM, CipherChaCha20Poly1305} {
+		c, _ := NewCipher(name, key)
+
+		sealed := c.Seal(nonce, []byte("Hello Crypt"))
+		sealed[0] ^= 0x01
+		_, err := c.Open(nonce, sealed)
+		assert.Equal(t, ErrAuthFailed, err, name)
+
+		sealed = c.Seal(nonce, []byte("Hello Crypt"))
+		otherNonce := make([]byte, 12)
+		otherNonce[11] = 1
+		_, err = c.Open(otherNonce, sealed)
+		assert.Equal(t, ErrAuthFailed, err, name)
+
+		// same plaintext under different nonce never gives same ciphertext
+		assert.NotEqual(t, c.Seal(nonce, []byte("Hello")), c.Seal(otherNonce, []byte("Hello")), name)
+	}
+}
+
+func TestCBCOpenBroken(t *testing.T) {
+	c := NewCrypto([]byte{0x12, 0x34, 0x56, 0x78})
+
+	_, err := c.Open(nil, []byte{0x01, 0x02})
+	assert.Equal(t, ErrAuthFailed, err)
+
+	_, err = c.Open(nil, nil)
+	assert.Equal(t, ErrAuthFailed, err)
+}
+
+func TestSession(t *testing.T) {
+	c2s, s2c := TrafficKeys([]byte("secret"), NewNonce(), []byte("client hello"), []byte("server hello"))
+	client, err := NewSession(CipherChaCha20Poly1305, c2s, s2c)
+	assert.Nil(t, err)
+	server, err := NewSession(CipherChaCha20Poly1305, s2c, c2s)
+	assert.Nil(t, err)
+
+	nonce := make([]byte, 12)
+	opened, err := server.Open(nonce, client.Seal(nonce, []byte("ping")))
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(opened))
+
+	// a block can not be reflected back to its sender
+	_, err = client.Open(nonce, client.Seal(nonce, []byte("ping")))
+	assert.Equal(t, ErrAuthFailed, err)
+}
@@ -39,25 +39,52 @@ func (c *Crypto) DecrypBlocks(dst []byte) []byte {
 	return dst[:len(dst)-int(dst[len(dst)-1])]
 }
 
+// Seal implements Cipher, cbc mode makes no use of nonce
+func (c *Crypto) Seal(nonce, plaintext []byte) []byte {
+	return c.CryptBlocks(plaintext)
+}
+
+// Open implements Cipher, checks length and padding instead of panic
+func (c *Crypto) Open(nonce, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrAuthFailed
+	}
+
+	cipher.NewCBCDecrypter(c.block, c.iv).CryptBlocks(ciphertext, ciphertext)
+	paddingSzB := int(ciphertext[len(ciphertext)-1])
+	if paddingSzB == 0 || paddingSzB > aes.BlockSize {
+		return nil, ErrAuthFailed
+	}
+	return ciphertext[:len(ciphertext)-paddingSzB], nil
+}
+
 // aesHelper returns aes cbc block mode
 // see https://golang.org/src/crypto/cipher/example_test.go for more information
 func aesHelper(password []byte) (cipher.Block, []byte) {
-	iv, err := scrypt.Key(password, password, 256, 8, 16, 16)
+	key, iv := deriveKey(password)
+
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		panic(err)
 	}
 
-	key, err := scrypt.Key(password, iv, 512, 8, 16, 32)
+	return block, iv
+}
+
+// deriveKey derives aes key and iv from password through scrypt,
+// iv salted by password itself, key salted by iv
+func deriveKey(password []byte) (key, iv []byte) {
+	iv, err := scrypt.Key(password, password, 256, 8, 16, 16)
 	if err != nil {
 		panic(err)
 	}
 
-	block, err := aes.NewCipher(key)
+	key, err = scrypt.Key(password, iv, 512, 8, 16, 32)
 	if err != nil {
 		panic(err)
 	}
 
-	return block, iv
+	return key, iv
 }
 
 // ScryptHelper returns random data build from scrypt
@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+)
+
+// supported ciphers
+const (
+	CipherAES256CBC        = "aes-256-cbc"
+	CipherAES256GCM        = "aes-256-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+var ErrAuthFailed = errors.New("crypto: message authentication failed")
+
+// Cipher seals and opens block payloads
+type Cipher interface {
+	// Seal encrypts plaintext, nonce must never repeat under the same key
+	Seal(nonce, plaintext []byte) []byte
+	// Open decrypts ciphertext, returns ErrAuthFailed if it was tampered with
+	Open(nonce, ciphertext []byte) ([]byte, error)
+}
+
+// NewCipher returns cipher by name
+func NewCipher(name string, key []byte) (Cipher, error) {
+	switch name {
+	case CipherAES256CBC:
+		return NewCrypto(key), nil
+	case CipherAES256GCM:
+		return NewAESGCM(key)
+	case CipherChaCha20Poly1305:
+		return NewChaCha20Poly1305(key)
+	default:
+		return nil, fmt.Errorf("crypto: unknown cipher %v", name)
+	}
+}
+
+// Session holds one cipher for each direction,
+// so both peers never seal with the same key
+type Session struct {
+	send Cipher
+	recv Cipher
+}
+
+// NewSession init ciphers of both directions
+func NewSession(name string, sendKey, recvKey []byte) (*Session, error) {
+	send, err := NewCipher(name, sendKey)
+	if err != nil {
+		return nil, err
+	}
+
+	recv, err := NewCipher(name, recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		send: send,
+		recv: recv,
+	}, nil
+}
+
+// Seal encrypts outgoing payload
+func (s *Session) Seal(nonce, plaintext []byte) []byte {
+	return s.send.Seal(nonce, plaintext)
+}
+
+// Open decrypts incoming payload
+func (s *Session) Open(nonce, ciphertext []byte) ([]byte, error) {
+	return s.recv.Open(nonce, ciphertext)
+}
@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var ErrInvalidIdentity = errors.New("crypto: invalid ed25519 key")
+
+var labelIdentity = []byte("shark identity")
+
+// NewIdentity generates long-term ed25519 server identity
+func NewIdentity() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// SignHandShake signs both handshake hellos with server identity
+func SignHandShake(identity ed25519.PrivateKey, clientHello, serverHello []byte) []byte {
+	return ed25519.Sign(identity, transcript(labelIdentity, clientHello, serverHello))
+}
+
+// VerifyHandShake reports whether sig is made by the pinned server identity
+func VerifyHandShake(pub ed25519.PublicKey, clientHello, serverHello, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(pub, transcript(labelIdentity, clientHello, serverHello), sig)
+}
+
+// EncodeKey encodes ed25519 key in base64
+func EncodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodePublicKey decodes base64 ed25519 public key
+func DecodePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrInvalidIdentity
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// DecodePrivateKey decodes base64 ed25519 private key
+func DecodePrivateKey(s string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidIdentity
+	}
+	return ed25519.PrivateKey(key), nil
+}
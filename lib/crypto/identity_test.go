@@ -0,0 +1,39 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignHandShake(t *testing.T) {
+	pub, priv, err := NewIdentity()
+	assert.Nil(t, err)
+
+	ch, sh := NewNonce(), NewNonce()
+	sig := SignHandShake(priv, ch, sh)
+	assert.True(t, VerifyHandShake(pub, ch, sh, sig))
+	assert.False(t, VerifyHandShake(pub, ch, NewNonce(), sig))
+	assert.False(t, VerifyHandShake(pub, ch, sh, nil))
+
+	other, _, _ := NewIdentity()
+	assert.False(t, VerifyHandShake(other, ch, sh, sig))
+	assert.False(t, VerifyHandShake(nil, ch, sh, sig))
+}
+
+func TestEncodeKey(t *testing.T) {
+	pub, priv, _ := NewIdentity()
+
+	decodedPub, err := DecodePublicKey(EncodeKey(pub) + "\n")
+	assert.Nil(t, err)
+	assert.Equal(t, pub, decodedPub)
+
+	decodedPriv, err := DecodePrivateKey(EncodeKey(priv))
+	assert.Nil(t, err)
+	assert.Equal(t, priv, decodedPriv)
+
+	_, err = DecodePublicKey(EncodeKey(priv))
+	assert.Equal(t, ErrInvalidIdentity, err)
+	_, err = DecodePrivateKey("not base64")
+	assert.Equal(t, ErrInvalidIdentity, err)
+}
@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	constX25519SzB = 32
+)
+
+var ErrInvalidPublicKey = errors.New("crypto: invalid x25519 public key")
+
+// KeyPair ephemeral x25519 key pair, used for one handshake only
+type KeyPair struct {
+	private [constX25519SzB]byte
+	Public  []byte
+}
+
+// NewKeyPair generates an ephemeral x25519 key pair
+func NewKeyPair() *KeyPair {
+	k := &KeyPair{}
+	if _, err := rand.Read(k.private[:]); err != nil {
+		panic(err)
+	}
+
+	var public [constX25519SzB]byte
+	curve25519.ScalarBaseMult(&public, &k.private)
+	k.Public = public[:]
+	return k
+}
+
+// SharedSecret returns x25519 shared secret with peer public key,
+// then wipes the private key
+func (k *KeyPair) SharedSecret(peer []byte) ([]byte, error) {
+	if len(peer) != constX25519SzB {
+		return nil, ErrInvalidPublicKey
+	}
+
+	var in, shared [constX25519SzB]byte
+	copy(in[:], peer)
+	curve25519.ScalarMult(&shared, &k.private, &in)
+	k.private = [constX25519SzB]byte{}
+
+	// low order points give all zero secret
+	var zero [constX25519SzB]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, ErrInvalidPublicKey
+	}
+	return shared[:], nil
+}
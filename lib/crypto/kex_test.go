@@ -0,0 +1,27 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedSecret(t *testing.T) {
+	client, server := NewKeyPair(), NewKeyPair()
+	assert.NotEqual(t, client.Public, server.Public)
+
+	s1, err := client.SharedSecret(server.Public)
+	assert.Nil(t, err)
+	s2, err := server.SharedSecret(client.Public)
+	assert.Nil(t, err)
+	assert.Equal(t, s1, s2)
+}
+
+func TestSharedSecretInvalid(t *testing.T) {
+	_, err := NewKeyPair().SharedSecret([]byte{0x01})
+	assert.Equal(t, ErrInvalidPublicKey, err)
+
+	// low order point
+	_, err = NewKeyPair().SharedSecret(make([]byte, 32))
+	assert.Equal(t, ErrInvalidPublicKey, err)
+}
@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	constNonceSzB = 32
+)
+
+const (
+	constTrafficKeySzB = 32
+)
+
+// labels keep client proof, server proof and traffic keys apart
+var (
+	labelSalt      = []byte("shark salt")
+	labelClientKey = []byte("shark client key")
+	labelServerKey = []byte("shark server key")
+	labelClient    = []byte("shark client")
+	labelServer    = []byte("shark server")
+	labelResume    = []byte("shark resume")
+)
+
+// NewNonce returns random bytes used once per handshake
+func NewNonce() []byte {
+	nonce := make([]byte, constNonceSzB)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return nonce
+}
+
+// TrafficKeys derives keys of client to server and server to client direction
+// from the ephemeral x25519 shared secret through hkdf; pre-shared key and both
+// handshake hellos go into the salt. A leaked pre-shared key can not recover
+// the keys of recorded sessions, as the shared secret is gone with the handshake.
+func TrafficKeys(psk, shared, clientHello, serverHello []byte) (c2s, s2c []byte) {
+	salt := mac(psk, labelSalt, clientHello, serverHello)
+	return expand(shared, salt, labelClientKey), expand(shared, salt, labelServerKey)
+}
+
+// ResumeSecret derives the secret of a session apart from its traffic keys,
+// a client resuming the session on a new connection proves to hold it
+func ResumeSecret(psk, shared, clientHello, serverHello []byte) []byte {
+	salt := mac(psk, labelSalt, clientHello, serverHello)
+	return expand(shared, salt, labelResume)
+}
+
+// ResumeProof proves the client holds secret of the session it resumes,
+// and binds hellos of the new connection
+func ResumeProof(secret, clientHello, serverHello []byte) []byte {
+	return mac(secret, labelResume, clientHello, serverHello)
+}
+
+func expand(secret, salt, info []byte) []byte {
+	key := make([]byte, constTrafficKeySzB)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// ClientProof proves the client holds the pre-shared key,
+// and binds everything negotiated in hellos
+func ClientProof(psk, clientHello, serverHello []byte) []byte {
+	return mac(psk, labelClient, clientHello, serverHello)
+}
+
+// ServerProof proves the server holds the pre-shared key
+func ServerProof(psk, clientHello, serverHello []byte) []byte {
+	return mac(psk, labelServer, clientHello, serverHello)
+}
+
+// VerifyProof compares proofs in constant time
+func VerifyProof(expected, actual []byte) bool {
+	return hmac.Equal(expected, actual)
+}
+
+func mac(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(transcript(data...))
+	return h.Sum(nil)
+}
+
+// transcript length-prefixes every part, so parts can not be shifted into each other
+func transcript(data ...[]byte) []byte {
+	buf := make([]byte, 0, 256)
+	l := make([]byte, 4)
+	for _, d := range data {
+		binary.BigEndian.PutUint32(l, uint32(len(d)))
+		buf = append(buf, l...)
+		buf = append(buf, d...)
+	}
+	return buf
+}
@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrafficKeys(t *testing.T) {
+	psk := []byte("shared secret")
+	shared := NewNonce()
+	ch, sh := NewNonce(), NewNonce()
+
+	c2s, s2c := TrafficKeys(psk, shared, ch, sh)
+	c2s2, s2c2 := TrafficKeys(psk, shared, ch, sh)
+	assert.Equal(t, c2s, c2s2)
+	assert.Equal(t, s2c, s2c2)
+	assert.NotEqual(t, c2s, s2c)
+	assert.Len(t, c2s, 32)
+
+	other, _ := TrafficKeys([]byte("other secret"), shared, ch, sh)
+	assert.NotEqual(t, c2s, other)
+	other, _ = TrafficKeys(psk, NewNonce(), ch, sh)
+	assert.NotEqual(t, c2s, other)
+	other, _ = TrafficKeys(psk, shared, ch, NewNonce())
+	assert.NotEqual(t, c2s, other)
+	assert.NotEqual(t, ClientProof(psk, ch, sh), ServerProof(psk, ch, sh))
+}
+
+func TestVerifyProof(t *testing.T) {
+	psk := []byte("shared secret")
+	ch, sh := NewNonce(), NewNonce()
+
+	assert.True(t, VerifyProof(ClientProof(psk, ch, sh), ClientProof(psk, ch, sh)))
+	assert.False(t, VerifyProof(ClientProof(psk, ch, sh), ClientProof([]byte("guess"), ch, sh)))
+	assert.False(t, VerifyProof(ClientProof(psk, ch, sh), nil))
+}
+
+func TestResumeSecret(t *testing.T) {
+	psk := []byte("shared secret")
+	shared := NewNonce()
+	ch, sh := NewNonce(), NewNonce()
+
+	secret := ResumeSecret(psk, shared, ch, sh)
+	c2s, s2c := TrafficKeys(psk, shared, ch, sh)
+	assert.Len(t, secret, 32)
+	assert.NotEqual(t, c2s, secret)
+	assert.NotEqual(t, s2c, secret)
+
+	// proof is bound to hellos of the new connection
+	proof := ResumeProof(secret, ch, sh)
+	assert.True(t, VerifyProof(proof, ResumeProof(secret, ch, sh)))
+	assert.False(t, VerifyProof(proof, ResumeProof(secret, ch, NewNonce())))
+	assert.False(t, VerifyProof(proof, ResumeProof(ResumeSecret(psk, NewNonce(), ch, sh), ch, sh)))
+}
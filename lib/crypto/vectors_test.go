@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// golden vectors in testdata/vectors.json pin key derivation and ciphers for other
+// implementations; never regenerate them, add vectors and bump Version instead.
+// Key of aes-256-cbc is the password given to NewCrypto.
+const constVectorsVersion = 2
+
+type keyVector struct {
+	Password string `json:"Password"`
+	Key      string `json:"Key"`
+	IV       string `json:"IV"`
+}
+
+type cipherVector struct {
+	Cipher     string `json:"Cipher"`
+	Key        string `json:"Key"`
+	Nonce      string `json:"Nonce"`
+	Plaintext  string `json:"Plaintext"`
+	Ciphertext string `json:"Ciphertext"`
+}
+
+type trafficKeysVector struct {
+	PSK         string `json:"PSK"`
+	Shared      string `json:"Shared"`
+	ClientHello string `json:"ClientHello"`
+	ServerHello string `json:"ServerHello"`
+	C2S         string `json:"C2S"`
+	S2C         string `json:"S2C"`
+	ClientProof string `json:"ClientProof"`
+	ServerProof string `json:"ServerProof"`
+}
+
+// resumeVector Proof is the resume proof of the same hellos
+type resumeVector struct {
+	PSK         string `json:"PSK"`
+	Shared      string `json:"Shared"`
+	ClientHello string `json:"ClientHello"`
+	ServerHello string `json:"ServerHello"`
+	Secret      string `json:"Secret"`
+	Proof       string `json:"Proof"`
+}
+
+type cryptoVectors struct {
+	Version     int                 `json:"Version"`
+	Keys        []keyVector         `json:"Keys"`
+	Ciphers     []cipherVector      `json:"Ciphers"`
+	TrafficKeys []trafficKeysVector `json:"TrafficKeys"`
+	Resume      []resumeVector      `json:"Resume"`
+}
+
+func loadVectors(t *testing.T) *cryptoVectors {
+	data, err := ioutil.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vectors cryptoVectors
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, constVectorsVersion, vectors.Version)
+	return &vectors
+}
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVectorsKeys(t *testing.T) {
+	for _, v := range loadVectors(t).Keys {
+		key, iv := deriveKey(unhex(t, v.Password))
+		assert.Equal(t, unhex(t, v.Key), key)
+		assert.Equal(t, unhex(t, v.IV), iv)
+	}
+}
+
+func TestVectorsCiphers(t *testing.T) {
+	for _, v := range loadVectors(t).Ciphers {
+		c, err := NewCipher(v.Cipher, unhex(t, v.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, plaintext, ciphertext := unhex(t, v.Nonce), unhex(t, v.Plaintext), unhex(t, v.Ciphertext)
+
+		// seal and open may work in place
+		assert.Equal(t, ciphertext, c.Seal(nonce, append([]byte{}, plaintext...)), v.Cipher)
+
+		d, err := c.Open(nonce, append([]byte{}, ciphertext...))
+		assert.Nil(t, err, v.Cipher)
+		assert.Equal(t, len(plaintext), len(d), v.Cipher)
+		if len(plaintext) > 0 {
+			assert.Equal(t, plaintext, d, v.Cipher)
+		}
+	}
+}
+
+func TestVectorsTrafficKeys(t *testing.T) {
+	for _, v := range loadVectors(t).TrafficKeys {
+		psk, ch, sh := unhex(t, v.PSK), unhex(t, v.ClientHello), unhex(t, v.ServerHello)
+
+		c2s, s2c := TrafficKeys(psk, unhex(t, v.Shared), ch, sh)
+		assert.Equal(t, unhex(t, v.C2S), c2s)
+		assert.Equal(t, unhex(t, v.S2C), s2c)
+		assert.Equal(t, unhex(t, v.ClientProof), ClientProof(psk, ch, sh))
+		assert.Equal(t, unhex(t, v.ServerProof), ServerProof(psk, ch, sh))
+	}
+}
+
+func TestVectorsResume(t *testing.T) {
+	vectors := loadVectors(t).Resume
+	assert.NotEmpty(t, vectors)
+	for _, v := range vectors {
+		ch, sh := unhex(t, v.ClientHello), unhex(t, v.ServerHello)
+
+		secret := ResumeSecret(unhex(t, v.PSK), unhex(t, v.Shared), ch, sh)
+		assert.Equal(t, unhex(t, v.Secret), secret)
+		assert.Equal(t, unhex(t, v.Proof), ResumeProof(secret, ch, sh))
+	}
+}
@@ -0,0 +1,25 @@
+package stream
+
+import (
+	"context"
+	"net"
+
+	"github.com/sunliver/shark/lib/block"
+)
+
+// Link is the connection carrying a session, replaced when the session is resumed
+type Link struct {
+	Conn   net.Conn
+	Reader *block.Reader
+	Writer *block.Writer
+	Ctx    context.Context
+	Cancel func()
+}
+
+// Close cancels routines of link and closes its connection
+func (l *Link) Close() {
+	if l.Cancel != nil {
+		l.Cancel()
+	}
+	_ = l.Conn.Close()
+}
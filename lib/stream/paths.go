@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sunliver/shark/lib/block"
+)
+
+// Path is another connection joined to a stream, carrying its data blocks with stream id
+// on the connection, see block.FeatureMultipath
+type Path struct {
+	// Conn relay or agent of the connection, paths are dropped by it
+	Conn interface{}
+	ID   uuid.UUID
+	// Bus queue of the connection, Done is closed once the connection is closed
+	Bus  chan<- *block.BlockData
+	Done <-chan struct{}
+}
+
+// Paths stripes data blocks of a stream over paths joined to it: a data block goes on
+// the path with fewest blocks queued, taking turns among equals; other blocks, and blocks
+// of paths gone, go on the connection opening the stream. Closed paths take no more paths
+type Paths struct {
+	mu sync.Mutex
+	// bus queue of the connection opening the stream
+	bus    chan<- *block.BlockData
+	paths  []*Path
+	turn   int
+	closed bool
+}
+
+// NewPaths init paths of a stream opened on connection queuing blocks in bus
+func NewPaths(bus chan<- *block.BlockData) *Paths {
+	return &Paths{bus: bus}
+}
+
+// Join stripes stream over p, it returns false once paths are closed
+func (ps *Paths) Join(p *Path) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.closed {
+		return false
+	}
+	ps.paths = append(ps.paths, p)
+	return true
+}
+
+// Drop stops striping over paths on closed connection conn, it reports whether any is dropped;
+// blocks peer did not consume may be gone with them and should be sent again
+func (ps *Paths) Drop(conn interface{}) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	paths := ps.paths[:0]
+	for _, p := range ps.paths {
+		if p.Conn != conn {
+			paths = append(paths, p)
+		}
+	}
+	dropped := len(paths) < len(ps.paths)
+	ps.paths = paths
+	return dropped
+}
+
+// Close takes no more paths, it returns the paths left for their connections to leave the stream
+func (ps *Paths) Close() []*Path {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.closed = true
+	paths := ps.paths
+	ps.paths = nil
+	return paths
+}
+
+// Stripe sends b on the path picked, or by send on the connection opening the stream;
+// it gives up once done is closed
+func (ps *Paths) Stripe(b *block.BlockData, send func(*block.BlockData), done <-chan struct{}) {
+	p := ps.pick(b)
+	if p == nil {
+		send(b)
+		return
+	}
+
+	pb := *b
+	pb.ID = p.ID
+	select {
+	case p.Bus <- &pb:
+	case <-p.Done:
+		send(b)
+	case <-done:
+	}
+}
+
+// pick returns path to send b on, nil for the connection opening the stream
+func (ps *Paths) pick(b *block.BlockData) *Path {
+	if b.Type != block.ConstBlockTypeData {
+		return nil
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	n := len(ps.paths) + 1
+	if n == 1 {
+		return nil
+	}
+	start := ps.turn % n
+	ps.turn++
+
+	var picked *Path
+	min := -1
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		var p *Path
+		queued := len(ps.bus)
+		if idx > 0 {
+			p = ps.paths[idx-1]
+			queued = len(p.Bus)
+		}
+		if min < 0 || queued < min {
+			picked, min = p, queued
+		}
+	}
+	return picked
+}
@@ -0,0 +1,82 @@
+package stream
+
+import (
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/sunliver/shark/lib/block"
+)
+
+func TestPaths(t *testing.T) {
+	opening := make(chan *block.BlockData, 8)
+	ps := NewPaths(opening)
+	send := func(b *block.BlockData) { opening <- b }
+	done := make(chan struct{})
+	data := &block.BlockData{ID: uuid.NewV4(), Type: block.ConstBlockTypeData}
+
+	// without paths blocks go on the connection opening the stream
+	ps.Stripe(data, send, done)
+	assert.Len(t, opening, 1)
+
+	bus := make(chan *block.BlockData, 8)
+	p := &Path{Conn: "a", ID: uuid.NewV4(), Bus: bus, Done: make(chan struct{})}
+	assert.True(t, ps.Join(p))
+
+	// data block goes on the path with fewer blocks queued, with stream id of the path
+	ps.Stripe(data, send, done)
+	if assert.Len(t, bus, 1) {
+		assert.Equal(t, p.ID, (<-bus).ID)
+	}
+	// other blocks go on the connection opening the stream
+	ps.Stripe(&block.BlockData{Type: block.ConstBlockTypeCloseWrite}, send, done)
+	assert.Len(t, opening, 2)
+
+	assert.False(t, ps.Drop("b"))
+	assert.True(t, ps.Drop("a"))
+	ps.Stripe(data, send, done)
+	assert.Len(t, opening, 3)
+
+	// closed paths take no more paths
+	assert.True(t, ps.Join(p))
+	assert.Equal(t, []*Path{p}, ps.Close())
+	assert.False(t, ps.Join(p))
+	assert.Empty(t, ps.Close())
+}
+
+func TestPathsTakeTurns(t *testing.T) {
+	opening := make(chan *block.BlockData, 8)
+	ps := NewPaths(opening)
+	send := func(b *block.BlockData) { opening <- b }
+	bus := make(chan *block.BlockData, 8)
+	ps.Join(&Path{Conn: "a", Bus: bus, Done: make(chan struct{})})
+
+	// paths with as many blocks queued take turns
+	data := &block.BlockData{Type: block.ConstBlockTypeData}
+	var on []bool
+	for i := 0; i < 4; i++ {
+		ps.Stripe(data, send, nil)
+		select {
+		case <-opening:
+			on = append(on, false)
+		case <-bus:
+			on = append(on, true)
+		}
+	}
+	assert.Equal(t, []bool{false, true, false, true}, on)
+}
+
+func TestPathsGone(t *testing.T) {
+	opening := make(chan *block.BlockData, 8)
+	ps := NewPaths(opening)
+	gone := make(chan struct{})
+	close(gone)
+	// path is full and gone, block goes on the connection opening the stream
+	ps.Join(&Path{Conn: "a", Bus: make(chan *block.BlockData), Done: gone})
+
+	data := &block.BlockData{Type: block.ConstBlockTypeData}
+	for i := 0; i < 2; i++ {
+		ps.Stripe(data, func(b *block.BlockData) { opening <- b }, nil)
+	}
+	assert.Len(t, opening, 2)
+}
@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"fmt"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sunliver/shark/lib/block"
+)
+
+// Receiver takes data blocks of a stream in order of block num, asking peer to send
+// broken ones again with block.FeatureResend and giving credits back with block.FeatureWindow.
+// It is used by the routine writing the stream only
+type Receiver struct {
+	id          uuid.UUID
+	resend      bool
+	flowControl bool
+	send        func(*block.BlockData)
+	// num block num expected of next data block
+	num uint32
+	// resending waits for resend of broken data block
+	resending bool
+}
+
+// NewReceiver init receiver of stream id, control blocks go to peer by send
+func NewReceiver(id uuid.UUID, resend, flowControl bool, send func(*block.BlockData)) *Receiver {
+	return &Receiver{
+		id:          id,
+		resend:      resend,
+		flowControl: flowControl,
+		send:        send,
+	}
+}
+
+// Num returns block num expected of next data block
+func (r *Receiver) Num() uint32 {
+	return r.num
+}
+
+// Data reports whether data block b is the next one; blocks sent again, or sent before
+// the broken one is resent, are dropped, other blocks out of order are an error
+func (r *Receiver) Data(b *block.BlockData) (bool, error) {
+	if b.BlockNum != r.num && r.resend && (r.resending || b.BlockNum < r.num) {
+		return false, nil
+	}
+	if b.BlockNum != r.num {
+		return false, fmt.Errorf("expected block num %v", r.num)
+	}
+	r.num++
+	r.resending = false
+	return true, nil
+}
+
+// Consumed gives credits back once half window of data blocks taken is consumed
+func (r *Receiver) Consumed() {
+	if r.flowControl && r.num%(block.ConstStreamWindow/2) == 0 {
+		r.send(&block.BlockData{
+			ID:       r.id,
+			Type:     block.ConstBlockTypeWindowUpdate,
+			BlockNum: r.num,
+		})
+	}
+}
+
+// Invalid asks for resend of broken data block b if it is the next one, it reports whether it asks
+func (r *Receiver) Invalid(b *block.BlockData) bool {
+	if b.BlockNum != r.num {
+		return false
+	}
+	r.resending = true
+	r.requestResend()
+	return true
+}
+
+// Resume asks for blocks from the next one again, those sent on the lost connection may be gone
+func (r *Receiver) Resume() {
+	r.resending = true
+	if r.flowControl {
+		r.send(&block.BlockData{
+			ID:       r.id,
+			Type:     block.ConstBlockTypeWindowUpdate,
+			BlockNum: r.num,
+		})
+	}
+	r.requestResend()
+}
+
+// CloseWrite reports whether close write block b comes after all data blocks;
+// it is dropped if resent after missing data blocks, otherwise out of order is an error
+func (r *Receiver) CloseWrite(b *block.BlockData) (bool, error) {
+	if b.BlockNum != r.num && r.resending {
+		return false, nil
+	}
+	if b.BlockNum != r.num {
+		return false, fmt.Errorf("expected block num %v", r.num)
+	}
+	return true, nil
+}
+
+func (r *Receiver) requestResend() {
+	r.send(&block.BlockData{
+		ID:       r.id,
+		Type:     block.ConstBlockTypeRequestResend,
+		BlockNum: r.num,
+	})
+}
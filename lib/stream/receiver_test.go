@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/sunliver/shark/lib/block"
+)
+
+func TestReceiver(t *testing.T) {
+	var sent []*block.BlockData
+	r := NewReceiver(uuid.NewV4(), true, true, func(b *block.BlockData) {
+		sent = append(sent, b)
+	})
+	data := func(num uint32) *block.BlockData {
+		return &block.BlockData{Type: block.ConstBlockTypeData, BlockNum: num}
+	}
+
+	// credits are given back once half window is consumed
+	for i := uint32(0); i < block.ConstStreamWindow/2; i++ {
+		next, err := r.Data(data(i))
+		assert.True(t, next)
+		assert.Nil(t, err)
+		r.Consumed()
+	}
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, block.ConstBlockTypeWindowUpdate, sent[0].Type)
+		assert.Equal(t, uint32(block.ConstStreamWindow/2), sent[0].BlockNum)
+	}
+	num := r.Num()
+
+	// blocks sent before the broken one is resent are dropped
+	assert.False(t, r.Invalid(data(num+1)))
+	assert.True(t, r.Invalid(data(num)))
+	assert.Equal(t, block.ConstBlockTypeRequestResend, sent[1].Type)
+	next, err := r.Data(data(num + 1))
+	assert.False(t, next)
+	assert.Nil(t, err)
+	next, err = r.CloseWrite(data(num + 2))
+	assert.False(t, next)
+	assert.Nil(t, err)
+	next, err = r.Data(data(num))
+	assert.True(t, next)
+	assert.Nil(t, err)
+
+	// blocks sent again are dropped
+	next, err = r.Data(data(num))
+	assert.False(t, next)
+	assert.Nil(t, err)
+
+	// a block skipped is an error once resend is done
+	_, err = r.Data(data(num + 2))
+	assert.NotNil(t, err)
+	_, err = r.CloseWrite(data(num + 2))
+	assert.NotNil(t, err)
+	next, err = r.CloseWrite(data(num + 1))
+	assert.True(t, next)
+	assert.Nil(t, err)
+
+	// resume asks for the next block again with credits
+	sent = nil
+	r.Resume()
+	if assert.Len(t, sent, 2) {
+		assert.Equal(t, block.ConstBlockTypeWindowUpdate, sent[0].Type)
+		assert.Equal(t, block.ConstBlockTypeRequestResend, sent[1].Type)
+		assert.Equal(t, num+1, sent[1].BlockNum)
+	}
+}
+
+func TestReceiverWithoutResend(t *testing.T) {
+	r := NewReceiver(uuid.NewV4(), false, false, func(b *block.BlockData) {
+		t.Errorf("unexpected block %v", b)
+	})
+
+	next, err := r.Data(&block.BlockData{Type: block.ConstBlockTypeData})
+	assert.True(t, next)
+	assert.Nil(t, err)
+	r.Consumed()
+
+	// blocks sent again are an error without resend
+	_, err = r.Data(&block.BlockData{Type: block.ConstBlockTypeData})
+	assert.NotNil(t, err)
+}
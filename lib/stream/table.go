@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Table streams of a connection by stream id, safe for the read routine looking
+// streams up while streams are added and removed by their own routines.
+// A closed table takes no more streams, those left are removed by their routines
+type Table struct {
+	mu      sync.RWMutex
+	streams map[uuid.UUID]interface{}
+	closed  bool
+}
+
+const tableInitSz = 64
+
+// NewTable init empty stream table
+func NewTable() *Table {
+	return &Table{
+		streams: make(map[uuid.UUID]interface{}, tableInitSz),
+	}
+}
+
+// Add keeps stream s by id, it returns false once table is closed
+func (t *Table) Add(id uuid.UUID, s interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.streams[id] = s
+	return true
+}
+
+// Get returns stream of id, nil if there is none
+func (t *Table) Get(id uuid.UUID) interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.streams[id]
+}
+
+// Remove forgets stream of id, it returns the count of streams left
+func (t *Table) Remove(id uuid.UUID) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.streams, id)
+	return len(t.streams)
+}
+
+// Len returns the count of streams
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.streams)
+}
+
+// Range calls f for each stream in table when it is called, f may add or remove streams
+func (t *Table) Range(f func(id uuid.UUID, s interface{})) {
+	t.mu.RLock()
+	ids := make([]uuid.UUID, 0, len(t.streams))
+	streams := make([]interface{}, 0, len(t.streams))
+	for id, s := range t.streams {
+		ids = append(ids, id)
+		streams = append(streams, s)
+	}
+	t.mu.RUnlock()
+
+	for i, id := range ids {
+		f(id, streams[i])
+	}
+}
+
+// Close takes no more streams, it returns false if table is closed before
+func (t *Table) Close() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.closed = true
+	return true
+}
@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"sync"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTable(t *testing.T) {
+	tb := NewTable()
+	a, b := uuid.NewV4(), uuid.NewV4()
+
+	assert.True(t, tb.Add(a, "a"))
+	assert.True(t, tb.Add(b, "b"))
+	assert.Equal(t, "a", tb.Get(a))
+	assert.Nil(t, tb.Get(uuid.NewV4()))
+	assert.Equal(t, 2, tb.Len())
+
+	// streams left are still removed by their routines once table is closed
+	assert.True(t, tb.Close())
+	assert.False(t, tb.Close())
+	assert.False(t, tb.Add(uuid.NewV4(), "c"))
+	assert.Equal(t, 1, tb.Remove(a))
+	assert.Nil(t, tb.Get(a))
+	assert.Equal(t, 0, tb.Remove(b))
+}
+
+func TestTableRange(t *testing.T) {
+	tb := NewTable()
+	for i := 0; i < 8; i++ {
+		tb.Add(uuid.NewV4(), i)
+	}
+
+	// f removes streams while ranging
+	seen := 0
+	tb.Range(func(id uuid.UUID, s interface{}) {
+		seen++
+		tb.Remove(id)
+	})
+	assert.Equal(t, 8, seen)
+	assert.Equal(t, 0, tb.Len())
+}
+
+func TestTableConcurrent(t *testing.T) {
+	tb := NewTable()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id := uuid.NewV4()
+				tb.Add(id, j)
+				tb.Get(id)
+				tb.Len()
+				tb.Range(func(uuid.UUID, interface{}) {})
+				tb.Remove(id)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 0, tb.Len())
+}
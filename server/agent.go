@@ -2,128 +2,364 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"net"
+	"reflect"
 	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/sunliver/shark/lib/block"
 	"github.com/sunliver/shark/lib/crypto"
+	"github.com/sunliver/shark/lib/stream"
+	"golang.org/x/crypto/ed25519"
 )
 
+// Conf server side configuration shared by agents
+type Conf struct {
+	// Key pre-shared secret which clients must prove to hold
+	Key []byte
+	// Ciphers allowed to seal block payloads
+	Ciphers []string
+	// Identity long-term key signing handshake, optional
+	Identity ed25519.PrivateKey
+	// Users accounts with their own keys, optional
+	Users *Users
+	// Replays rejects replayed handshakes, shared by all agents
+	Replays *ReplayCache
+	// MaxBodySz max body size of blocks, 0 for block.ConstMaxBodySzB
+	MaxBodySz int
+	// PingInterval between pings to client, 0 disables pings
+	PingInterval time.Duration
+	// PingTimeout closes agent once nothing is read from pinged client for so long,
+	// 0 for constPingTimeout
+	PingTimeout time.Duration
+	// Sessions keeps sessions of lost connections for clients to resume, optional
+	Sessions *Sessions
+	// Joins keeps streams for other agents of clients to join, optional
+	Joins *Joins
+	// UDPTimeout closes UDP associations idle for so long, 0 disables UDP associate
+	UDPTimeout time.Duration
+	// BindTimeout closes BIND listeners without inbound connection for so long,
+	// 0 disables BIND
+	BindTimeout time.Duration
+}
+
 type Agent struct {
-	ID     uuid.UUID
-	conn   net.Conn
-	crypto *crypto.Crypto
+	ID uuid.UUID
+	// link current connection, nil while agent is parked; guarded by mu
+	link   *stream.Link
+	conf   *Conf
+	crypto *crypto.Session
 	log    logrus.FieldLogger
-	bus    chan []byte
-	relays map[uuid.UUID]*relay
-	mu     sync.RWMutex
-	ctx    context.Context
-	cancel func()
+	bus    chan *block.BlockData
+	// relays streams opened on agent and joined to it, by stream id on agent
+	relays *stream.Table
+	// associations UDP associations opened on agent, by stream id
+	associations *stream.Table
+	mu           sync.RWMutex
+	ctx          context.Context
+	cancel       func()
+	// user bound in handshake
+	user string
+	// negotiated in handshake
+	version  uint32
+	cipher   string
+	features []string
+	// flowControl streams are throttled by windows, see block.Window
+	flowControl bool
+	// halfClose streams shut down each direction on its own
+	halfClose bool
+	// resend streams ask for resend of broken data blocks
+	resend bool
+	// keepAlive client answers pings
+	keepAlive bool
+	// multipath streams are striped over agents joining them
+	multipath bool
+	// goAway client is told when agent is shut down
+	goAway bool
+	// udp client opens UDP associations
+	udp bool
+	// bind client opens streams of inbound connections
+	bind bool
+	// draining agent is not parked; if closeIdle it is released once its streams
+	// are done, else client closes it. Guarded by mu
+	draining  bool
+	closeIdle bool
+	// established agent is past handshake, guarded by mu
+	established bool
+	// streams rejects streams opened before, guarded by mu
+	streams replayWindow
+	// ticket and secret of resumable session, see block.FeatureResume
+	ticket       []byte
+	resumeSecret []byte
+	// resumed session taken over by connection of agent in handshake
+	resumed *Agent
 }
 
 const (
-	agentBusSz       = 64
-	agentRelayInitSz = 64
+	agentBusSz = 64
+)
+
+const (
+	constPingTimeout  = time.Second * 60
+	constWriteTimeout = time.Second * 60
 )
 
-func NewServer(ctx context.Context, conn net.Conn) *Agent {
+func NewServer(ctx context.Context, conn net.Conn, conf *Conf) *Agent {
 	c, cancel := context.WithCancel(ctx)
 	id := uuid.NewV4()
 	return &Agent{
 		ID:     id,
 		ctx:    c,
 		cancel: cancel,
-		conn:   conn,
-		relays: make(map[uuid.UUID]*relay, agentRelayInitSz),
-		bus:    make(chan []byte, agentBusSz),
-		log:    logrus.WithField("agent", short(id)).WithField("conn", conn.RemoteAddr()),
+		link: &stream.Link{
+			Conn:   conn,
+			Reader: block.NewReader(conn, conf.MaxBodySz),
+			Writer: block.NewWriter(conn),
+		},
+		conf:         conf,
+		relays:       stream.NewTable(),
+		associations: stream.NewTable(),
+		bus:          make(chan *block.BlockData, agentBusSz),
+		log:          logrus.WithField("agent", short(id)).WithField("conn", conn.RemoteAddr()),
 	}
 }
 
 func (a *Agent) Run() {
-	if err := a.handShake(); err != nil {
+	l := a.link
+	// client not finishing handshake is dead
+	_ = l.Conn.SetDeadline(time.Now().Add(a.pingTimeout()))
+	if err := a.handShake(l); err != nil {
 		a.log.Errorf("handshake failed, %v", err)
+		a.release()
+		return
+	}
+	_ = l.Conn.SetDeadline(time.Time{})
+
+	a.mu.Lock()
+	a.established = true
+	draining := a.draining
+	a.mu.Unlock()
+	if draining {
+		a.log.Infof("agent is shut down in handshake")
+		if a.resumed != nil {
+			a.conf.Sessions.Park(a.resumed)
+		}
+		a.release()
+		return
+	}
+
+	if a.resumed != nil {
+		a.log.Infof("handshake success, resume agent %v", short(a.resumed.ID))
+		a.resumed.resume(l)
+		a.cancel()
+		return
+	}
+
+	a.log.Infof("handshake success, %v", l.Conn.RemoteAddr())
+
+	if a.user != "" && a.conf.Users != nil && !a.conf.Users.attach(a) {
+		a.log.Warnf("user is revoked in handshake, close agent")
+		a.release()
 		return
 	}
+	if a.ticket != nil {
+		a.conf.Sessions.Add(a)
+	}
+	a.attach(l)
+}
+
+// attach makes l the connection of agent and starts its routines,
+// the previous connection is closed
+func (a *Agent) attach(l *stream.Link) {
+	l.Ctx, l.Cancel = context.WithCancel(a.ctx)
 
-	a.log.Infof("handshake success, %v", a.conn.RemoteAddr())
+	a.mu.Lock()
+	prev := a.link
+	a.link = l
+	a.mu.Unlock()
+	if prev != nil && prev != l {
+		prev.Close()
+	}
 
-	go a.read()
-	go a.write()
+	go a.read(l)
+	go a.write(l)
+	if a.pinging() {
+		go a.ping(l)
+	}
 }
 
-func (a *Agent) read() {
+// resume goes on with session on connection l, relays ask for resend of
+// blocks lost with the previous connection
+func (a *Agent) resume(l *stream.Link) {
+	a.log.Infof("session resumed on %v", l.Conn.RemoteAddr())
+	a.attach(l)
+
+	a.relays.Range(func(_ uuid.UUID, s interface{}) {
+		r := s.(*relay)
+		if !r.deliver(&block.BlockData{ID: r.id, Type: block.ConstBlockTypeResume}) {
+			r.log.Errorf("stream is overrun, close stream")
+			r.abort()
+		}
+	})
+}
+
+// lost closes connection l; agent of resumable session is parked
+// for client to resume it, otherwise it is released
+func (a *Agent) lost(l *stream.Link) {
+	l.Close()
+
+	a.mu.Lock()
+	current := a.link == l
+	if current {
+		a.link = nil
+	}
+	draining := a.draining
+	a.mu.Unlock()
+	if !current {
+		// replaced by connection resuming the session
+		return
+	}
+
+	if a.ticket == nil || a.ctx.Err() != nil || draining {
+		a.release()
+		return
+	}
+	a.log.Infof("connection lost, wait %v for client to resume", a.conf.Sessions.timeout)
+	a.conf.Sessions.Park(a)
+}
+
+// expire releases agent still parked
+func (a *Agent) expire() {
+	a.mu.RLock()
+	parked := a.link == nil
+	a.mu.RUnlock()
+
+	if parked {
+		a.log.Infof("session is not resumed in time")
+		a.release()
+	}
+}
+
+func (a *Agent) read(l *stream.Link) {
 	a.log.Debugf("read routine start")
 	defer a.log.Debugf("read routine stop")
-	defer a.release()
+	defer a.lost(l)
 
 	for {
 		select {
-		case <-a.ctx.Done():
-			err := a.ctx.Err()
+		case <-l.Ctx.Done():
+			err := l.Ctx.Err()
 			a.log.Infof("close server, %v", err)
 			return
 		default:
-			buf := make([]byte, block.ConstBlockHeaderSzB)
-			if n, err := io.ReadFull(a.conn, buf); err != nil || n < len(buf) {
-				a.log.Errorf("read broken header, %v", err)
-				return
+			if a.pinging() {
+				_ = l.Conn.SetReadDeadline(time.Now().Add(a.pingTimeout()))
 			}
 
-			blockData, err := block.UnMarshalHeader(buf)
-			if err != nil {
-				a.log.Errorf("unmarshal header failed, %v", err)
+			blockData, err := l.Reader.Read()
+			if err == block.ErrInvalidBody && a.resend && blockData.Type == block.ConstBlockTypeData {
+				// stream asks for resend of it
+				blockData.Type = block.ConstBlockTypeInvalid
+				blockData.Data = nil
+			} else if err != nil {
+				a.log.Errorf("read block failed, %v", err)
 				return
 			}
 
-			if blockData.Length > 0 {
-				body := make([]byte, blockData.Length)
-				if n, err := io.ReadFull(a.conn, body); err != nil || n < len(body) {
-					a.log.Errorf("broken package, %v", err)
+			if blockData.Type == block.ConstBlockTypePing {
+				a.send(&block.BlockData{
+					Type:     block.ConstBlockTypePong,
+					BlockNum: blockData.BlockNum,
+				})
+			} else if blockData.Type == block.ConstBlockTypePong {
+				// client is alive, read deadline is extended already
+				a.log.Debugf("recv pong %v", blockData.BlockNum)
+			} else if blockData.Type == block.ConstBlockTypeGoAway {
+				a.log.Infof("client is going away, drain streams")
+				a.drain(true)
+			} else if relay := a.relay(blockData.ID); relay != nil {
+				// blocks of joined streams go on as on the agent opening it
+				blockData.ID = relay.id
+				if blockData.Type == block.ConstBlockTypeWindowUpdate {
+					relay.window.Ack(blockData.BlockNum)
+				} else if blockData.Type == block.ConstBlockTypeRequestResend {
+					relay.resend(blockData.BlockNum)
+				} else if !relay.deliver(blockData) {
+					relay.log.Errorf("peer overruns stream window, close stream")
+					relay.abort()
+				}
+			} else if as := a.association(blockData.ID); as != nil {
+				as.deliver(blockData)
+			} else if blockData.Type == block.ConstBlockTypeConnect || blockData.Type == block.ConstBlockTypeFastConnect ||
+				blockData.Type == block.ConstBlockTypeBind {
+				if !a.authorized() {
+					a.log.Warnf("user is revoked, close agent")
+					a.cancel()
 					return
 				}
-				blockData.Data = body
-			}
-
-			if relay, ok := a.relays[blockData.ID]; ok {
-				relay.bus <- blockData
+				r := newRelay(a, blockData.ID)
+				if a.registerRelay(r) {
+					go r.run()
+					r.bus <- blockData
+				}
+			} else if blockData.Type == block.ConstBlockTypeJoin {
+				a.join(blockData)
+			} else if blockData.Type == block.ConstBlockTypeAssociate {
+				if !a.authorized() {
+					a.log.Warnf("user is revoked, close agent")
+					a.cancel()
+					return
+				}
+				a.associate(blockData)
+			} else if blockData.Type == block.ConstBlockTypeRequestResend {
+				// stream is closed while its disconnect block was lost
+				a.send(&block.BlockData{
+					ID:   blockData.ID,
+					Type: block.ConstBlockTypeDisconnect,
+				})
 			} else {
-				a.registerRelay(newRelay(a, blockData.ID))
-				a.mu.RLock()
-				go a.relays[blockData.ID].run()
-				a.relays[blockData.ID].bus <- blockData
-				a.mu.RUnlock()
+				// stream is closed, or never opened
+				a.log.Debugf("drop block of unknown stream, %v", blockData)
 			}
 		}
 	}
 }
 
-func (a *Agent) write() {
+func (a *Agent) write(l *stream.Link) {
 	a.log.Debugf("write routine start")
 	defer a.log.Debugf("write routine stop")
-	defer a.release()
+	defer a.lost(l)
 
-	for b := range a.bus {
-		if n, err := a.conn.Write(b); err != nil || n < len(b) {
-			a.log.Warnf("write back failed, %v", err)
+	for {
+		select {
+		case <-l.Ctx.Done():
 			return
+		case b := <-a.bus:
+			_ = l.Conn.SetWriteDeadline(time.Now().Add(constWriteTimeout))
+			if err := l.Writer.Write(b); err != nil {
+				a.log.Warnf("write back failed, %v", err)
+				return
+			}
 		}
 	}
 }
 
-func (a *Agent) handShake() error {
-	// 1. recv handshake and send handshake
-	{
-		buf := make([]byte, block.ConstBlockHeaderSzB)
-		if n, err := io.ReadFull(a.conn, buf); err != nil || n < len(buf) {
-			return err
-		}
+func (a *Agent) handShake(l *stream.Link) error {
+	var clientHello, serverHello, shared, key, clientNonce, ticket []byte
+	var clientTimestamp int64
+	var cipher string
+	// keyErr of unknown users fails the handshake only at client proof, as a wrong key does,
+	// so that user names can not be told apart
+	var keyErr error
+	var resumed *Agent
 
-		blockData, err := block.UnMarshalHeader(buf)
+	// 1. recv handshake with client nonce and ephemeral key, send server's
+	{
+		blockData, err := l.Reader.Read()
 		if err != nil {
 			return err
 		}
@@ -131,22 +367,69 @@ func (a *Agent) handShake() error {
 			return fmt.Errorf("expected handshake, get %v", blockData.Type)
 		}
 
-		handshakeData := block.Marshal(&block.BlockData{
-			Type: block.ConstBlockTypeHandShake,
-		})
-		if n, err := a.conn.Write(handshakeData); err != nil || n < len(handshakeData) {
+		var hello block.HandShakeData
+		if err := json.Unmarshal(blockData.Data, &hello); err != nil || len(hello.Nonce) == 0 {
+			return fmt.Errorf("invalid handshake, %v", err)
+		}
+		if a.conf.Replays != nil {
+			if err := a.conf.Replays.Check(hello.Nonce, hello.Timestamp); err != nil {
+				return err
+			}
+		}
+		clientNonce = hello.Nonce
+		clientTimestamp = hello.Timestamp
+		if key, keyErr = a.keyOf(hello.User); keyErr != nil {
+			key = crypto.NewNonce()
+		}
+		a.user = hello.User
+		if a.version, err = block.SelectVersion(hello.Version); err != nil {
 			return err
 		}
-	}
+		ciphers := block.Select(hello.OfferedCiphers(), a.conf.Ciphers)
+		if len(ciphers) == 0 {
+			return fmt.Errorf("none of ciphers %v is allowed", hello.OfferedCiphers())
+		}
+		cipher = ciphers[0]
+		a.features = block.Select(hello.Features, a.supported())
+		clientHello = blockData.Data
 
-	// 2. recv passwd negotiation
-	{
-		buf := make([]byte, block.ConstBlockHeaderSzB)
-		if n, err := io.ReadFull(a.conn, buf); err != nil || n < len(buf) {
+		if block.Contains(a.features, block.FeatureResume) {
+			if hello.Ticket != nil {
+				resumed = a.conf.Sessions.Lookup(hello.Ticket, a.user)
+			}
+			if resumed != nil && resumed.resumable(a.version, cipher, a.features) {
+				ticket = resumed.ticket
+			} else {
+				resumed = nil
+				ticket = crypto.NewNonce()
+			}
+		}
+
+		keyPair := crypto.NewKeyPair()
+		if shared, err = keyPair.SharedSecret(hello.PublicKey); err != nil {
 			return err
 		}
 
-		blockData, err := block.UnMarshalHeader(buf)
+		serverHello, _ = json.Marshal(&block.HandShakeData{
+			Version:   a.version,
+			Nonce:     crypto.NewNonce(),
+			PublicKey: keyPair.Public,
+			Cipher:    cipher,
+			Features:  a.features,
+			Ticket:    ticket,
+			Resumed:   resumed != nil,
+		})
+		if err := l.Writer.Write(&block.BlockData{
+			Type: block.ConstBlockTypeHandShake,
+			Data: serverHello,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// 2. recv client proof and send server proof
+	{
+		blockData, err := l.Reader.Read()
 		if err != nil {
 			return err
 		}
@@ -154,53 +437,334 @@ func (a *Agent) handShake() error {
 			return fmt.Errorf("expected handshake resp, get %v", blockData.Type)
 		}
 
-		if blockData.Length > 0 {
-			body := make([]byte, blockData.Length)
-			if n, err := io.ReadFull(a.conn, body); err != nil || n < len(body) {
+		var resp block.HandShakeData
+		if err := json.Unmarshal(blockData.Data, &resp); err != nil {
+			return fmt.Errorf("invalid handshake resp, %v", err)
+		}
+		if !crypto.VerifyProof(crypto.ClientProof(key, clientHello, serverHello), resp.Proof) || keyErr != nil {
+			a.log.Debugf("client proof of user %q is not verified, %v", a.user, keyErr)
+			return fmt.Errorf("client proof mismatch, reject")
+		}
+		if a.conf.Replays != nil {
+			if err := a.conf.Replays.CheckAndAdd(clientNonce, clientTimestamp); err != nil {
 				return err
 			}
+		}
+		if resumed != nil {
+			if !crypto.VerifyProof(crypto.ResumeProof(resumed.resumeSecret, clientHello, serverHello), resp.ResumeProof) {
+				return fmt.Errorf("resume proof mismatch, reject")
+			}
+			// session taken is parked again if handshake fails from here
+			if a.conf.Sessions.Take(ticket, a.user) != resumed {
+				return fmt.Errorf("session to resume is expired")
+			}
+		}
 
-			a.crypto = crypto.NewCrypto(body)
-
-			handShakeFinal := block.Marshal(&block.BlockData{
-				ID:   blockData.ID,
-				Type: block.ConstBlockTypeHandShakeFinal,
-			})
-
-			if n, err := a.conn.Write(handShakeFinal); err != nil || n < len(handShakeFinal) {
-				return err
+		final := &block.HandShakeData{
+			Proof: crypto.ServerProof(key, clientHello, serverHello),
+		}
+		if a.conf.Identity != nil {
+			final.Identity = a.conf.Identity.Public().(ed25519.PublicKey)
+			final.Signature = crypto.SignHandShake(a.conf.Identity, clientHello, serverHello)
+		}
+		data, _ := json.Marshal(final)
+		if err := l.Writer.Write(&block.BlockData{
+			ID:   blockData.ID,
+			Type: block.ConstBlockTypeHandShakeFinal,
+			Data: data,
+		}); err != nil {
+			if resumed != nil {
+				a.conf.Sessions.Park(resumed)
 			}
-		} else {
-			return fmt.Errorf("invalid handshake resp")
+			return err
 		}
 	}
 
+	// blocks after handshake go in frames of negotiated version
+	l.Reader.SetVersion(a.version)
+	l.Writer.SetVersion(a.version)
+	if resumed != nil {
+		// keys and streams go on with the resumed session
+		a.resumed = resumed
+		return nil
+	}
+
+	c2s, s2c := crypto.TrafficKeys(key, shared, clientHello, serverHello)
+	session, err := crypto.NewSession(cipher, s2c, c2s)
+	if err != nil {
+		return err
+	}
+	a.crypto = session
+	a.cipher = cipher
+	a.flowControl = block.Contains(a.features, block.FeatureWindow)
+	a.halfClose = block.Contains(a.features, block.FeatureHalfClose)
+	a.resend = block.Contains(a.features, block.FeatureResend)
+	a.keepAlive = block.Contains(a.features, block.FeatureKeepAlive)
+	a.multipath = block.Contains(a.features, block.FeatureMultipath) && a.flowControl && a.resend && a.halfClose
+	a.goAway = block.Contains(a.features, block.FeatureGoAway)
+	a.udp = block.Contains(a.features, block.FeatureUDP)
+	a.bind = block.Contains(a.features, block.FeatureBind)
+	if ticket != nil {
+		a.ticket = ticket
+		a.resumeSecret = crypto.ResumeSecret(key, shared, clientHello, serverHello)
+	}
+	a.log = a.log.WithField("user", a.user).WithField("version", a.version).WithField("cipher", cipher)
+	a.log.Infof("negotiated version %v, cipher %v, features %v", a.version, cipher, a.features)
+
 	// ready to recv data
 	return nil
 }
 
-func (a *Agent) registerRelay(r *relay) {
+// supported features, sessions are resumable and streams are joined if server keeps them,
+// UDP associations and BIND listeners are opened if they expire
+func (a *Agent) supported() []string {
+	features := block.Features
+	if a.conf.Sessions == nil {
+		features = block.Without(features, block.FeatureResume)
+	}
+	if a.conf.Joins == nil {
+		features = block.Without(features, block.FeatureMultipath)
+	}
+	if a.conf.UDPTimeout <= 0 {
+		features = block.Without(features, block.FeatureUDP)
+	}
+	if a.conf.BindTimeout <= 0 {
+		features = block.Without(features, block.FeatureBind)
+	}
+	return features
+}
+
+// resumable reports whether session goes on with what is negotiated on a new connection
+func (a *Agent) resumable(version uint32, cipher string, features []string) bool {
+	return a.ticket != nil && a.version == version && a.cipher == cipher && reflect.DeepEqual(a.features, features)
+}
+
+// pinging reports whether agent pings client, then client must answer in time
+func (a *Agent) pinging() bool {
+	return a.keepAlive && a.conf.PingInterval > 0
+}
+
+func (a *Agent) pingTimeout() time.Duration {
+	if a.conf.PingTimeout > 0 {
+		return a.conf.PingTimeout
+	}
+	return constPingTimeout
+}
+
+func (a *Agent) ping(l *stream.Link) {
+	t := time.NewTicker(a.conf.PingInterval)
+	defer t.Stop()
+
+	var seq uint32
+	for {
+		select {
+		case <-l.Ctx.Done():
+			return
+		case <-t.C:
+			seq++
+			a.send(&block.BlockData{
+				Type:     block.ConstBlockTypePing,
+				BlockNum: seq,
+			})
+		}
+	}
+}
+
+// send queues block to client, gives up once agent is closed
+func (a *Agent) send(b *block.BlockData) {
+	select {
+	case a.bus <- b:
+	case <-a.ctx.Done():
+	}
+}
+
+// join stripes stream of token sealed in join block over agent, see block.FeatureMultipath;
+// agent of a revoked user is closed instead, adding no more paths to its streams
+func (a *Agent) join(b *block.BlockData) {
+	if !a.authorized() {
+		a.log.Warnf("user is revoked, close agent")
+		a.cancel()
+		return
+	}
+
+	var r *relay
+	token, err := a.crypto.Open(b.Nonce(), b.Data)
+	if err == nil && a.multipath && a.acceptStream(b.ID) {
+		r = a.conf.Joins.Lookup(token, a.user)
+	}
+	if r == nil {
+		a.log.Warnf("reject join block %v, %v", b, err)
+		a.send(&block.BlockData{
+			ID:   b.ID,
+			Type: block.ConstBlockTypeDisconnect,
+		})
+		return
+	}
+
+	if a.relays.Add(b.ID, r) && !r.join(a, b.ID) {
+		a.leave(b.ID)
+	}
+}
+
+// leave stops carrying blocks of joined stream id
+func (a *Agent) leave(id uuid.UUID) {
+	if left := a.relays.Remove(id); left == 0 && a.closingIdle() {
+		a.release()
+	}
+}
+
+// Shutdown tells client agent is going away, so client opens no more streams on it
+// and does not resume it; agent is released once its streams are done or ctx is done
+func (a *Agent) Shutdown(ctx context.Context) {
+	// agent in handshake is closed, client tries again on another connection
 	a.mu.Lock()
-	defer a.mu.Unlock()
+	established := a.established
+	if !established {
+		a.draining = true
+		_ = a.link.Conn.Close()
+	}
+	a.mu.Unlock()
 
-	a.relays[r.id] = r
+	if established {
+		if a.goAway {
+			// client closes the connection once its streams are done
+			a.send(&block.BlockData{Type: block.ConstBlockTypeGoAway})
+		}
+		a.drain(!a.goAway)
+	}
 
-	a.log.Debugf("relay is registered, %v", short(r.id))
+	select {
+	case <-a.ctx.Done():
+	case <-ctx.Done():
+		a.log.Warnf("streams are not drained in time, %v", ctx.Err())
+		a.release()
+	}
 }
 
-func (a *Agent) unregisterRelay(r *relay) {
+// Done is closed once agent is released
+func (a *Agent) Done() <-chan struct{} {
+	return a.ctx.Done()
+}
+
+// drain does not park agent any more,
+// if closeIdle agent is released once its streams are done
+func (a *Agent) drain(closeIdle bool) {
+	if a.ticket != nil {
+		a.conf.Sessions.Remove(a)
+	}
+
+	a.mu.Lock()
+	a.draining = true
+	a.closeIdle = a.closeIdle || closeIdle
+	// parked agent is never resumed now
+	parked := a.link == nil
+	a.mu.Unlock()
+
+	if parked || a.relays.Len() == 0 && a.closingIdle() {
+		a.release()
+	}
+}
+
+// closingIdle reports whether agent not released yet is to be released once its streams are done
+func (a *Agent) closingIdle() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.closeIdle && a.ctx.Err() == nil
+}
+
+// acceptStream reports whether stream is never opened before
+func (a *Agent) acceptStream(id uuid.UUID) bool {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	delete(a.relays, r.id)
+	return a.streams.Accept(block.StreamSeq(id))
+}
+
+// keyOf returns pre-shared key of user,
+// clients without user name share the server key
+func (a *Agent) keyOf(name string) ([]byte, error) {
+	if name == "" {
+		if a.conf.Key == nil {
+			return nil, fmt.Errorf("user name is required")
+		}
+		return a.conf.Key, nil
+	}
+
+	if a.conf.Users != nil {
+		if user, ok := a.conf.Users.Lookup(name); ok {
+			return []byte(user.Key), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown or disabled user %q", name)
+}
+
+// authorized reports whether bound user is still enabled
+func (a *Agent) authorized() bool {
+	if a.user == "" {
+		return true
+	}
+	_, err := a.keyOf(a.user)
+	return err == nil
+}
+
+// relay returns stream of id on agent, nil if there is none
+func (a *Agent) relay(id uuid.UUID) *relay {
+	if r, ok := a.relays.Get(id).(*relay); ok {
+		return r
+	}
+	return nil
+}
+
+// registerRelay keeps relay of stream opened on agent, it returns false once agent is released
+func (a *Agent) registerRelay(r *relay) bool {
+	if !a.relays.Add(r.id, r) {
+		r.log.Warnf("agent is closed, drop relay")
+		return false
+	}
+
+	a.log.Debugf("relay is registered, %v", short(r.id))
+	return true
+}
+
+func (a *Agent) unregisterRelay(r *relay) {
+	left := a.relays.Remove(r.id)
 
 	a.log.Debugf("relay is unregistered, %v", short(r.id))
+
+	if left == 0 && a.closingIdle() {
+		a.release()
+	}
 }
 
 func (a *Agent) release() {
 	a.cancel()
-	a.conn.Close()
-	a.relays = nil
+	a.mu.Lock()
+	if a.link != nil {
+		a.link.Close()
+	}
+	a.mu.Unlock()
+	if a.ticket != nil {
+		a.conf.Sessions.Remove(a)
+	}
+	if a.user != "" && a.conf.Users != nil {
+		a.conf.Users.detach(a)
+	}
+
+	if a.associations.Close() {
+		a.associations.Range(func(_ uuid.UUID, s interface{}) {
+			s.(*association).release()
+		})
+	}
+
+	// streams striped over agent go on without it
+	if a.relays.Close() {
+		a.relays.Range(func(id uuid.UUID, s interface{}) {
+			if r := s.(*relay); id != r.id || r.a != a {
+				r.dropPath(a)
+			}
+		})
+	}
 
 	a.log.Debugf("agent is closed")
 }
@@ -0,0 +1,1547 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sunliver/shark/client"
+	"github.com/sunliver/shark/lib/block"
+	"github.com/sunliver/shark/lib/crypto"
+)
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// echo serves remote conns, reports every conn closed by the server
+func echo(l net.Listener, closed chan<- struct{}) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(conn, conn)
+			_ = conn.Close()
+			closed <- struct{}{}
+		}()
+	}
+}
+
+// tunnel runs a server behind l, returns manager of client dialing addr and agents once they are up;
+// key and ciphers of client conf are set to server's unless set, server pings, resumes and joins streams
+// as client does, client keeps a relay for each path; udp associations expire in a second
+func tunnel(ctx context.Context, l net.Listener, addr string, cconf *client.RelayConf) (*client.Manager, <-chan *Agent) {
+	conf := &Conf{
+		Key:          []byte("shared secret"),
+		Ciphers:      []string{crypto.CipherChaCha20Poly1305},
+		PingInterval: cconf.PingInterval,
+		PingTimeout:  cconf.PingTimeout,
+		UDPTimeout:   time.Second,
+		BindTimeout:  time.Second,
+	}
+	if cconf.ResumeTimeout > 0 {
+		conf.Sessions = NewSessions(cconf.ResumeTimeout)
+	}
+	if cconf.Paths > 1 {
+		conf.Joins = NewJoins()
+	}
+	return tunnelConf(ctx, l, addr, conf, cconf)
+}
+
+// tunnelConf runs a server of conf behind l, returns manager of client dialing addr and
+// agents once they are up; key and ciphers of client conf are set to server's unless set
+func tunnelConf(ctx context.Context, l net.Listener, addr string, conf *Conf, cconf *client.RelayConf) (*client.Manager, <-chan *Agent) {
+	agents := make(chan *Agent, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			a := NewServer(ctx, conn, conf)
+			a.Run()
+			agents <- a
+		}
+	}()
+
+	if cconf.Key == nil {
+		cconf.Key = conf.Key
+	}
+	if cconf.Ciphers == nil {
+		cconf.Ciphers = conf.Ciphers
+	}
+	coreSz := 1
+	if cconf.Paths > 1 {
+		coreSz = cconf.Paths
+	}
+	return client.NewManager(coreSz, addr, cconf), agents
+}
+
+// connect opens a stream to remote through HTTP CONNECT
+func connect(t *testing.T, m *client.Manager, local, conn net.Conn, remote net.Addr) {
+	go m.Start(conn, &client.HttpProxy{})
+
+	fmt.Fprintf(local, "CONNECT %v HTTP/1.1\r\n\r\n", remote)
+	resp := make([]byte, len(client.HTTPSuccess))
+	if _, err := io.ReadFull(local, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, client.HTTPSuccess, resp)
+}
+
+func TestStreamClose(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	closed := make(chan struct{}, 8)
+	go echo(remote, closed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	for i := 0; i < 3; i++ {
+		local, conn := net.Pipe()
+		connect(t, m, local, conn, remote.Addr())
+
+		_, _ = local.Write([]byte("ping"))
+		resp := make([]byte, 4)
+		_, err := io.ReadFull(local, resp)
+		assert.Nil(t, err)
+		assert.Equal(t, "ping", string(resp))
+
+		// closing local conn closes remote conn
+		_ = local.Close()
+		select {
+		case <-closed:
+		case <-time.After(time.Second * 5):
+			t.Fatal("remote conn is not closed")
+		}
+	}
+
+	a := <-agents
+	for i := 0; i < 100 && relaysOf(a) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 0, relaysOf(a))
+}
+
+func relaysOf(a *Agent) int {
+	return a.relays.Len()
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	// remote answers once client is done writing
+	remote := listen(t)
+	defer remote.Close()
+	go func() {
+		conn, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := ioutil.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("re: "), req...))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	// half-close needs tcp on local side
+	locals := listen(t)
+	defer locals.Close()
+	local, err := net.Dial("tcp", locals.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	conn, err := locals.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect(t, m, local, conn, remote.Addr())
+
+	_, _ = local.Write([]byte("ping"))
+	assert.Nil(t, local.(*net.TCPConn).CloseWrite())
+	resp, err := ioutil.ReadAll(local)
+	assert.Nil(t, err)
+	assert.Equal(t, "re: ping", string(resp))
+
+	a := <-agents
+	for i := 0; i < 100 && relaysOf(a) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 0, relaysOf(a))
+}
+
+// corrupt forwards client conns to server, breaking body of the first data block
+func corrupt(l net.Listener, server string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	up, err := net.Dial("tcp", server)
+	if err != nil {
+		return
+	}
+	defer up.Close()
+	go io.Copy(conn, up)
+
+	r := block.NewReader(conn, 0)
+	w := block.NewWriter(up)
+	broken := false
+	for i := 0; ; i++ {
+		if i == 2 {
+			// handshake is done
+			r.SetVersion(block.ConstProtocolMaxVersion)
+			w.SetVersion(block.ConstProtocolMaxVersion)
+		}
+		b, err := r.Read()
+		if err != nil {
+			return
+		}
+		if b.Type == block.ConstBlockTypeData && !broken {
+			broken = true
+			frame := block.MarshalV2(b)
+			frame[len(frame)-1] ^= 0xff
+			_, _ = up.Write(frame)
+			continue
+		}
+		_ = w.Write(b)
+	}
+}
+
+func TestStreamStalled(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+	// flood writes to each conn until it is closed
+	flood := listen(t)
+	defer flood.Close()
+	go func() {
+		for {
+			conn, err := flood.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	// local of the flooded stream stops reading, far past the credits of a window
+	stalled, conn := net.Pipe()
+	defer stalled.Close()
+	connect(t, m, stalled, conn, flood.Addr())
+	a := <-agents
+	time.Sleep(time.Millisecond * 200)
+
+	// another stream on the same relay goes on
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	transfer(t, local, block.ConstStreamWindow*4*1024, func() {})
+	assert.Equal(t, 2, relaysOf(a))
+}
+
+func TestStreamResend(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	proxy := listen(t)
+	defer proxy.Close()
+	go corrupt(proxy, l.Addr().String())
+	m, _ := tunnel(ctx, l, proxy.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+
+	_, _ = local.Write([]byte("ping"))
+	resp := make([]byte, 4)
+	_, err := io.ReadFull(local, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(resp))
+}
+
+func TestStreamFastConnect(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, _ := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{FastConnect: true})
+	defer m.Cancel()
+
+	// first data goes with fast connect
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	_, _ = local.Write([]byte("ping"))
+	resp := make([]byte, 4)
+	_, err := io.ReadFull(local, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(resp))
+
+	// local conn is closed if remote can not be connected
+	closed := listen(t)
+	closed.Close()
+	local, conn = net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, closed.Addr())
+	_, err = io.ReadFull(local, resp)
+	assert.Equal(t, io.EOF, err)
+}
+
+// freezer forwards conns to addr, once frozen it drops everything silently like a lost NAT mapping
+type freezer struct {
+	frozen int32
+}
+
+func (f *freezer) serve(l net.Listener, addr string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		up, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		go f.forward(conn, up)
+		go f.forward(up, conn)
+	}
+}
+
+func (f *freezer) forward(dst, src net.Conn) {
+	defer dst.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&f.frozen) == 0 {
+			_, _ = dst.Write(buf[:n])
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	proxy := listen(t)
+	defer proxy.Close()
+	f := &freezer{}
+	go f.serve(proxy, l.Addr().String())
+	m, agents := tunnel(ctx, l, proxy.Addr().String(), &client.RelayConf{
+		PingInterval: time.Millisecond * 20,
+		PingTimeout:  time.Millisecond * 200,
+	})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+
+	// idle relay is kept alive by pings
+	time.Sleep(time.Millisecond * 500)
+	_, _ = local.Write([]byte("ping"))
+	resp := make([]byte, 4)
+	_, err := io.ReadFull(local, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(resp))
+
+	// dead relay is closed by both sides
+	atomic.StoreInt32(&f.frozen, 1)
+	_ = local.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = io.ReadFull(local, resp)
+	assert.Equal(t, io.EOF, err)
+
+	a := <-agents
+	select {
+	case <-a.ctx.Done():
+	case <-time.After(time.Second * 2):
+		t.Fatal("dead client is not detected")
+	}
+
+	// a new relay replaces the dead one
+	atomic.StoreInt32(&f.frozen, 0)
+	local, conn = net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+}
+
+// breaker forwards conns to addr, cut closes conns forwarded so far like a network blip
+type breaker struct {
+	mu    sync.Mutex
+	conns []net.Conn
+	// replays, if set, takes nonce of client hello before client proves itself,
+	// as if another connection replays the handshake; spoiled counts such handshakes
+	replays *ReplayCache
+	spoiled int32
+}
+
+func (b *breaker) serve(l net.Listener, addr string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		up, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns = append(b.conns, conn, up)
+		replays := b.replays
+		b.mu.Unlock()
+		go func() {
+			if replays != nil {
+				b.spoil(up, conn, replays)
+			}
+			_, _ = io.Copy(up, conn)
+			_ = up.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(conn, up)
+			_ = conn.Close()
+		}()
+	}
+}
+
+// spoil forwards client hello of conn to up, then takes its nonce into replays
+// before forwarding the proof client answers server hello with
+func (b *breaker) spoil(up, conn net.Conn, replays *ReplayCache) {
+	blockData, err := block.NewReader(io.TeeReader(conn, up), 0).Read()
+	if err != nil {
+		return
+	}
+	var hello block.HandShakeData
+	if err := json.Unmarshal(blockData.Data, &hello); err != nil {
+		return
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	_ = replays.CheckAndAdd(hello.Nonce, hello.Timestamp)
+	atomic.AddInt32(&b.spoiled, 1)
+	_, _ = up.Write(buf[:n])
+}
+
+func (b *breaker) cut() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, conn := range b.conns {
+		_ = conn.Close()
+	}
+	b.conns = nil
+}
+
+func TestResume(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	proxy := listen(t)
+	defer proxy.Close()
+	b := &breaker{}
+	go b.serve(proxy, l.Addr().String())
+	m, agents := tunnel(ctx, l, proxy.Addr().String(), &client.RelayConf{ResumeTimeout: time.Second * 5})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	// stream goes on across connections, blocks lost on the way are resent
+	transfer(t, local, 256*1024, b.cut)
+
+	assert.Nil(t, a.ctx.Err())
+	assert.Equal(t, 1, relaysOf(a))
+}
+
+func TestResumeExpired(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{ResumeTimeout: time.Second})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	// server is down longer than resume timeout, session and its streams are gone
+	_ = l.Close()
+	a.mu.RLock()
+	a.link.Close()
+	a.mu.RUnlock()
+	select {
+	case <-a.ctx.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("lost session is not released")
+	}
+	_ = local.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(local, make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestResumeReplayed(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	proxy := listen(t)
+	defer proxy.Close()
+	b := &breaker{}
+	go b.serve(proxy, l.Addr().String())
+	conf := &Conf{
+		Key:      []byte("shared secret"),
+		Ciphers:  []string{crypto.CipherChaCha20Poly1305},
+		Sessions: NewSessions(time.Second),
+		Replays:  NewReplayCache(time.Minute, 64),
+	}
+	m, agents := tunnelConf(ctx, l, proxy.Addr().String(), conf, &client.RelayConf{ResumeTimeout: time.Second})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	// resumes rejected by replay cache leave the session parked, it expires in time
+	b.mu.Lock()
+	b.replays = conf.Replays
+	b.mu.Unlock()
+	b.cut()
+	select {
+	case <-a.ctx.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("session is not released after rejected resume")
+	}
+	assert.NotZero(t, atomic.LoadInt32(&b.spoiled))
+	_ = local.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(local, make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// transfer echoes data of size through local, calling halfway once half is echoed
+func transfer(t *testing.T, local net.Conn, size int, halfway func()) {
+	data := make([]byte, size)
+	rand.Read(data)
+	go func() {
+		for i := 0; i < len(data); i += 1024 {
+			if _, err := local.Write(data[i : i+1024]); err != nil {
+				return
+			}
+		}
+	}()
+
+	resp := make([]byte, len(data))
+	_ = local.SetReadDeadline(time.Now().Add(time.Second * 10))
+	_, err := io.ReadFull(local, resp[:len(data)/2])
+	assert.Nil(t, err)
+	halfway()
+	_, err = io.ReadFull(local, resp[len(data)/2:])
+	assert.Nil(t, err)
+	assert.Equal(t, data, resp)
+}
+
+func TestMultipath(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{Paths: 2})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	// the other relay joins the stream
+	var joined *Agent
+	select {
+	case joined = <-agents:
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream is not joined")
+	}
+	for i := 0; i < 100 && relaysOf(joined) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 1, relaysOf(joined))
+
+	// blocks go over both relays, and over the one left once the other is closed
+	transfer(t, local, 256*1024, func() {
+		joined.mu.RLock()
+		joined.link.Close()
+		joined.mu.RUnlock()
+	})
+	assert.Nil(t, a.ctx.Err())
+	assert.Equal(t, 1, relaysOf(a))
+}
+
+// echoed sends data through local and asserts it is echoed back
+func echoed(t *testing.T, local net.Conn, data string) {
+	_, _ = local.Write([]byte(data))
+	resp := make([]byte, len(data))
+	_ = local.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(local, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, data, string(resp))
+}
+
+func draining(a *Agent) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.draining
+}
+
+func TestShutdown(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{ResumeTimeout: time.Second * 5})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	drain, stop := context.WithTimeout(ctx, time.Second*5)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		a.Shutdown(drain)
+		close(done)
+	}()
+	for i := 0; i < 100 && !draining(a); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// echo goes after go away, stream opened before goes on
+	echoed(t, local, "ping")
+
+	// new streams go on a new relay
+	other, conn := net.Pipe()
+	defer other.Close()
+	connect(t, m, other, conn, remote.Addr())
+	b := <-agents
+	assert.NotEqual(t, a, b)
+	echoed(t, other, "pong")
+
+	// agent is released once its stream is done, its session is not kept
+	_ = local.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("drained agent is not released")
+	}
+	assert.NotNil(t, a.ctx.Err())
+	assert.Nil(t, a.conf.Sessions.Lookup(a.ticket, a.user))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	// streams left at the deadline are closed
+	drain, stop := context.WithTimeout(ctx, time.Millisecond*200)
+	defer stop()
+	a.Shutdown(drain)
+	assert.NotNil(t, a.ctx.Err())
+	_ = local.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(local, make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestShutdownHandShake(t *testing.T) {
+	// client never finishes handshake
+	local, conn := net.Pipe()
+	defer local.Close()
+	a := NewServer(context.Background(), conn, &Conf{Key: []byte("k")})
+	ran := make(chan struct{})
+	go func() {
+		a.Run()
+		close(ran)
+	}()
+
+	// agent in handshake is closed at once, without waiting for the deadline
+	drain, stop := context.WithTimeout(context.Background(), time.Second*5)
+	defer stop()
+	start := time.Now()
+	a.Shutdown(drain)
+	assert.Nil(t, drain.Err())
+	assert.True(t, time.Since(start) < time.Second)
+	select {
+	case <-ran:
+	case <-time.After(time.Second * 3):
+		t.Fatal("handshake is not stopped")
+	}
+	_, err := local.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestClientShutdown(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{ResumeTimeout: time.Second * 5})
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	drain, stop := context.WithTimeout(ctx, time.Second*5)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown(drain)
+		close(done)
+	}()
+	for i := 0; i < 100 && !draining(a); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, draining(a))
+	echoed(t, local, "ping")
+
+	// client exits once its stream is done, server does not wait for it to resume
+	_ = local.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("client is not drained")
+	}
+	select {
+	case <-a.ctx.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("agent of client going away is not released")
+	}
+}
+
+func TestClientShutdownReplaced(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+
+	// relay told to go away by server is replaced in its slot
+	drain, stop := context.WithTimeout(ctx, time.Second*5)
+	defer stop()
+	go a.Shutdown(drain)
+	for i := 0; i < 100 && !draining(a); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	other, conn := net.Pipe()
+	connect(t, m, other, conn, remote.Addr())
+	<-agents
+	echoed(t, other, "pong")
+	_ = other.Close()
+
+	// client waits for the stream of the replaced relay too
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown(drain)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("stream of replaced relay is not drained")
+	case <-time.After(time.Millisecond * 200):
+	}
+	echoed(t, local, "ping")
+
+	_ = local.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("client is not drained")
+	}
+
+	// no relay is created once client is shut down
+	late, conn := net.Pipe()
+	defer late.Close()
+	go m.Start(conn, &client.HttpProxy{})
+	_ = late.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(late, make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// storm opens n streams through m at once; a third is closed before remote is connected,
+// a third once it is, the rest after echo
+func storm(t *testing.T, m *client.Manager, remote net.Addr, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			local, conn := net.Pipe()
+			defer local.Close()
+			go m.Start(conn, &client.HttpProxy{})
+
+			fmt.Fprintf(local, "CONNECT %v HTTP/1.1\r\n\r\n", remote)
+			if i%3 == 0 {
+				return
+			}
+			resp := make([]byte, len(client.HTTPSuccess))
+			_ = local.SetReadDeadline(time.Now().Add(time.Second * 10))
+			_, err := io.ReadFull(local, resp)
+			assert.Nil(t, err)
+			if i%3 == 1 {
+				return
+			}
+			echoed(t, local, fmt.Sprintf("ping %v", i))
+		}(i)
+	}
+	wg.Wait()
+}
+
+// idle asserts streams of agents are all gone
+func idle(t *testing.T, agents ...*Agent) {
+	for _, a := range agents {
+		for i := 0; i < 300 && relaysOf(a) > 0; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Equal(t, 0, relaysOf(a))
+	}
+}
+
+func TestStreamStorm(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	for i := 0; i < 3; i++ {
+		storm(t, m, remote.Addr(), 64)
+	}
+	idle(t, <-agents)
+}
+
+func TestStreamStormMultipath(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{Paths: 2, ResumeTimeout: time.Second * 5})
+	defer m.Cancel()
+
+	for i := 0; i < 3; i++ {
+		storm(t, m, remote.Addr(), 64)
+	}
+	first := []*Agent{<-agents, <-agents}
+	idle(t, first...)
+
+	// agents going away while streams are opened and closed, new streams go on new relays
+	done := make(chan struct{})
+	go func() {
+		storm(t, m, remote.Addr(), 64)
+		close(done)
+	}()
+	drain, stop := context.WithTimeout(ctx, time.Second*10)
+	defer stop()
+	var wg sync.WaitGroup
+	for _, a := range first {
+		wg.Add(1)
+		go func(a *Agent) {
+			defer wg.Done()
+			a.Shutdown(drain)
+		}(a)
+	}
+	wg.Wait()
+	<-done
+	assert.Nil(t, drain.Err())
+}
+
+// udpEcho echoes datagrams until conn is closed
+func udpEcho(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		_, _ = conn.WriteToUDP(buf[:n], addr)
+	}
+}
+
+// associate asks for socks5 udp associate through m, returns the control conn
+// and the address to send datagrams to
+func associate(t *testing.T, m *client.Manager) (net.Conn, *net.UDPAddr) {
+	local := listen(t)
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		m.Start(conn, &client.SocksProxy{SocksProxyConf: &client.SocksProxyConf{}})
+	}()
+
+	conn, err := net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x01}, resp[:6])
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, &net.UDPAddr{IP: net.IP(resp[6:10]), Port: int(resp[10])<<8 | int(resp[11])}
+}
+
+func associationsOf(a *Agent) int {
+	return a.associations.Len()
+}
+
+func TestUDPAssociate(t *testing.T) {
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go udpEcho(remote)
+	raddr := remote.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	ctrl, bnd := associate(t, m)
+	a := <-agents
+	assert.Equal(t, 1, associationsOf(a))
+
+	pc, err := net.DialUDP("udp", nil, bnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// datagrams come back from remote in socks5 udp request header
+	header := append([]byte{0x00, 0x00, 0x00, 0x01}, raddr.IP.To4()...)
+	header = append(header, byte(raddr.Port>>8), byte(raddr.Port))
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("ping %v", i))
+		_, _ = pc.Write(append(header, data...))
+
+		buf := make([]byte, 2048)
+		_ = pc.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, err := pc.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, append(header, data...), buf[:n])
+	}
+
+	// closing control conn closes the association
+	_ = ctrl.Close()
+	for i := 0; i < 100 && associationsOf(a) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 0, associationsOf(a))
+}
+
+func TestUDPAssociateExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, agents := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	ctrl, _ := associate(t, m)
+	defer ctrl.Close()
+	a := <-agents
+
+	// idle association is closed by server, and so is control conn
+	_ = ctrl.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err := io.ReadFull(ctrl, make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, associationsOf(a))
+}
+
+// bind asks for socks bind of a peer on 127.0.0.1 through m, returns the local conn
+// and the address server listens on
+func bind(t *testing.T, m *client.Manager, ver byte) (net.Conn, *net.TCPAddr) {
+	local := listen(t)
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		m.Start(conn, &client.SocksProxy{SocksProxyConf: &client.SocksProxyConf{}})
+	}()
+
+	conn, err := net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if ver == 0x04 {
+		_, _ = conn.Write([]byte{0x04, 0x02, 0x00, 0x00, 127, 0, 0, 1, 0x00})
+	} else {
+		_, _ = conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		greet := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := bound(t, conn, ver)
+	_ = conn.SetDeadline(time.Time{})
+	return conn, addr
+}
+
+// bound reads a bind reply, returns the address in it
+func bound(t *testing.T, conn net.Conn, ver byte) *net.TCPAddr {
+	if ver == 0x04 {
+		resp := make([]byte, 8)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []byte{0x00, 0x5a}, resp[:2])
+		return &net.TCPAddr{IP: net.IP(resp[4:8]), Port: int(resp[2])<<8 | int(resp[3])}
+	}
+	resp := make([]byte, 10)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte{0x05, 0x00, 0x00, 0x01}, resp[:4])
+	return &net.TCPAddr{IP: net.IP(resp[4:8]), Port: int(resp[8])<<8 | int(resp[9])}
+}
+
+func TestBind(t *testing.T) {
+	for _, ver := range []byte{0x04, 0x05} {
+		ctx, cancel := context.WithCancel(context.Background())
+		l := listen(t)
+		m, _ := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+
+		conn, addr := bind(t, m, ver)
+		assert.Equal(t, "127.0.0.1", addr.IP.String())
+		assert.NotZero(t, addr.Port)
+
+		// peer connecting to bound address is told to local by the second reply
+		peer, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+		assert.Equal(t, peer.LocalAddr().String(), bound(t, conn, ver).String())
+
+		_ = peer.SetDeadline(time.Now().Add(time.Second * 5))
+		_, _ = peer.Write([]byte("from peer"))
+		buf := make([]byte, 9)
+		_, err = io.ReadFull(conn, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "from peer", string(buf))
+		_, _ = conn.Write([]byte("to peer"))
+		buf = make([]byte, 7)
+		_, err = io.ReadFull(peer, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "to peer", string(buf))
+
+		_ = peer.Close()
+		_ = conn.Close()
+		m.Cancel()
+		_ = l.Close()
+		cancel()
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, _ := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	conn, addr := bind(t, m, 0x05)
+	defer conn.Close()
+
+	// no inbound connection in bind timeout fails the bind, TTL expired, listener is closed
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	resp := make([]byte, 10)
+	_, err := io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x05, 0x06, 0x00, 0x01}, resp[:4])
+	_, err = net.Dial("tcp", addr.String())
+	assert.NotNil(t, err)
+}
+
+func TestSocksRemoteResolve(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+	port := remote.Addr().(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, _ := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	// domain name goes to server verbatim, server resolves it
+	local, conn := net.Pipe()
+	defer local.Close()
+	go m.Start(conn, &client.SocksProxy{SocksProxyConf: &client.SocksProxyConf{Addr: []byte{0, 0, 0, 0}, Port: []byte{0, 0}}})
+	_ = local.SetDeadline(time.Now().Add(time.Second * 5))
+
+	_, _ = local.Write([]byte{0x05, 0x01, 0x00})
+	greet := make([]byte, 2)
+	_, err := io.ReadFull(local, greet)
+	assert.Nil(t, err)
+	req := append([]byte{0x05, 0x01, 0x00, 0x03, 9}, "localhost"...)
+	_, _ = local.Write(append(req, byte(port>>8), byte(port)))
+	resp := make([]byte, 10)
+	_, err = io.ReadFull(local, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x05, 0x00}, resp[:2])
+
+	_, _ = local.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(local, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestConnectFailedReason(t *testing.T) {
+	// nothing listens on the port of a closed listener
+	closed := listen(t)
+	raddr := closed.Addr().(*net.TCPAddr)
+	_ = closed.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	m, _ := tunnel(ctx, l, l.Addr().String(), &client.RelayConf{})
+	defer m.Cancel()
+
+	// socks5 client is told connection refused
+	local, conn := net.Pipe()
+	go m.Start(conn, &client.SocksProxy{SocksProxyConf: &client.SocksProxyConf{}})
+	_ = local.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = local.Write([]byte{0x05, 0x01, 0x00})
+	_, err := io.ReadFull(local, make([]byte, 2))
+	assert.Nil(t, err)
+	req := append([]byte{0x05, 0x01, 0x00, 0x01}, raddr.IP.To4()...)
+	_, _ = local.Write(append(req, byte(raddr.Port>>8), byte(raddr.Port)))
+	resp := make([]byte, 10)
+	_, err = io.ReadFull(local, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x05, 0x05, 0x00, 0x01}, resp[:4])
+
+	// http client is told bad gateway
+	local, conn = net.Pipe()
+	go m.Start(conn, &client.HttpProxy{})
+	_ = local.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprintf(local, "CONNECT %v HTTP/1.1\r\n\r\n", raddr)
+	resp, _ = ioutil.ReadAll(local)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 502 Bad Gateway\r\n"), "%q", resp)
+}
+
+// recorder forwards connections to addr, recording bytes of the first connection
+type recorder struct {
+	net.Listener
+	mu   sync.Mutex
+	sent []byte
+	recv []byte
+}
+
+func record(t *testing.T, addr string) *recorder {
+	r := &recorder{Listener: listen(t)}
+	first := true
+	go func() {
+		for {
+			conn, err := r.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			rec := first
+			first = false
+			go r.pipe(server, conn, rec, &r.sent)
+			go r.pipe(conn, server, rec, &r.recv)
+		}
+	}()
+	return r
+}
+
+func (r *recorder) pipe(dst, src net.Conn, rec bool, buf *[]byte) {
+	defer dst.Close()
+	defer src.Close()
+	b := make([]byte, 4096)
+	for {
+		n, err := src.Read(b)
+		if n > 0 && rec {
+			r.mu.Lock()
+			*buf = append(*buf, b[:n]...)
+			r.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+		if _, err := dst.Write(b[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// bytes returns bytes client sent and received on the first connection
+func (r *recorder) bytes() ([]byte, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.sent...), append([]byte(nil), r.recv...)
+}
+
+// rejected asks for a stream from client of cconf through server of conf, asserts
+// the handshake fails and no stream is opened; returns bytes server sent to client
+func rejected(t *testing.T, conf *Conf, cconf *client.RelayConf) []byte {
+	remote := listen(t)
+	defer remote.Close()
+	opened := make(chan struct{}, 8)
+	go func() {
+		for {
+			conn, err := remote.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+			opened <- struct{}{}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	rec := record(t, l.Addr().String())
+	defer rec.Close()
+	m, agents := tunnelConf(ctx, l, rec.Addr().String(), conf, cconf)
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	go m.Start(conn, &client.HttpProxy{})
+	go fmt.Fprintf(local, "CONNECT %v HTTP/1.1\r\n\r\n", remote.Addr())
+
+	select {
+	case a := <-agents:
+		select {
+		case <-a.Done():
+		case <-time.After(time.Second * 5):
+			t.Fatal("agent is not released")
+		}
+		assert.Equal(t, 0, a.relays.Len())
+	case <-time.After(time.Second * 5):
+		t.Fatal("client does not connect")
+	}
+	select {
+	case <-opened:
+		t.Error("stream is opened")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	_, recv := rec.bytes()
+	return recv
+}
+
+func TestHandShakeUser(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shark")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	writeUsers(t, path, `[
+		{"Name": "alice", "Key": "alice-key", "Enabled": true},
+		{"Name": "bob", "Key": "bob-key", "Enabled": false}
+	]`, time.Now())
+	users, err := LoadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := func() *Conf {
+		return &Conf{
+			Ciphers: []string{crypto.CipherChaCha20Poly1305},
+			Users:   users,
+		}
+	}
+
+	// wrong key, disabled user and unknown user all fail at client proof,
+	// server answers the hello of each alike
+	for _, cconf := range []*client.RelayConf{
+		{User: "alice", Key: []byte("wrong-key")},
+		{User: "bob", Key: []byte("bob-key")},
+		{User: "mallory", Key: []byte("mallory-key")},
+	} {
+		recv := rejected(t, conf(), cconf)
+		assert.NotEmpty(t, recv, cconf.User)
+	}
+}
+
+func TestJoinRevoked(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shark")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	writeUsers(t, path, `[{"Name": "bob", "Key": "bob-key", "Enabled": false}]`, time.Now())
+	users, err := LoadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// user disabled after handshake joins no more streams
+	local, conn := net.Pipe()
+	defer local.Close()
+	a := NewServer(context.Background(), conn, &Conf{Users: users, Joins: NewJoins()})
+	a.user = "bob"
+	a.join(&block.BlockData{ID: block.NewStreamID(1), Type: block.ConstBlockTypeJoin})
+
+	select {
+	case <-a.Done():
+	case <-time.After(time.Second):
+		t.Fatal("agent of revoked user is not closed")
+	}
+	assert.Equal(t, 0, a.relays.Len())
+}
+
+func TestStreamRevoked(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shark")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	writeUsers(t, path, `[{"Name": "alice", "Key": "alice-key", "Enabled": true}]`, time.Now().Add(-time.Minute))
+	users, err := LoadUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := listen(t)
+	defer remote.Close()
+	go echo(remote, make(chan struct{}, 8))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	conf := &Conf{
+		Ciphers: []string{crypto.CipherChaCha20Poly1305},
+		Users:   users,
+	}
+	m, agents := tunnelConf(ctx, l, l.Addr().String(), conf, &client.RelayConf{User: "alice", Key: []byte("alice-key")})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	a := <-agents
+	transfer(t, local, 4096, func() {})
+
+	// established stream of user disabled on reload is torn down
+	writeUsers(t, path, `[{"Name": "alice", "Key": "alice-key", "Enabled": false}]`, time.Now())
+	assert.Nil(t, users.reload())
+	select {
+	case <-a.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("agent of revoked user is not closed")
+	}
+	_ = local.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = io.ReadFull(local, make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHandShakeWrongKey(t *testing.T) {
+	conf := &Conf{
+		Key:     []byte("shared secret"),
+		Ciphers: []string{crypto.CipherChaCha20Poly1305},
+	}
+	rejected(t, conf, &client.RelayConf{Key: []byte("wrong secret")})
+}
+
+func TestHandShakeIdentityMismatch(t *testing.T) {
+	_, identity, _ := crypto.NewIdentity()
+	pinned, _, _ := crypto.NewIdentity()
+	conf := &Conf{
+		Key:      []byte("shared secret"),
+		Ciphers:  []string{crypto.CipherChaCha20Poly1305},
+		Identity: identity,
+	}
+
+	// client pinning another identity drops the connection once server proves itself
+	recv := rejected(t, conf, &client.RelayConf{ServerPubKey: pinned})
+	assert.NotEmpty(t, recv)
+}
+
+func TestHandShakeReplayed(t *testing.T) {
+	remote := listen(t)
+	defer remote.Close()
+	closed := make(chan struct{}, 8)
+	go echo(remote, closed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	defer l.Close()
+	rec := record(t, l.Addr().String())
+	defer rec.Close()
+	conf := &Conf{
+		Key:     []byte("shared secret"),
+		Ciphers: []string{crypto.CipherChaCha20Poly1305},
+		Replays: NewReplayCache(time.Minute, 64),
+	}
+	m, agents := tunnelConf(ctx, l, rec.Addr().String(), conf, &client.RelayConf{})
+	defer m.Cancel()
+
+	local, conn := net.Pipe()
+	defer local.Close()
+	connect(t, m, local, conn, remote.Addr())
+	<-agents
+
+	// bytes of the recorded connection replayed on a new one open nothing,
+	// server does not even answer the hello
+	sent, _ := rec.bytes()
+	replay, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	_ = replay.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = replay.Write(sent)
+	recv, _ := ioutil.ReadAll(replay)
+	assert.Empty(t, recv)
+
+	a := <-agents
+	<-a.Done()
+	assert.Equal(t, 0, a.relays.Len())
+}
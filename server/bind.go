@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sunliver/shark/lib/block"
+)
+
+// bind listens for the inbound connection of a BIND stream, see block.FeatureBind:
+// client is told the address listened on by a Bound block, only a connection from
+// expected peer is taken. It gives up once Conf.BindTimeout passes or client closes stream
+func (r *relay) bind(expected *block.HostData) (net.Conn, error) {
+	if !r.a.bind {
+		return nil, fmt.Errorf("bind is not negotiated, %w", errDenied)
+	}
+
+	// listen on the address client reaches server at, so that peers reach it too
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: r.a.localIP()})
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	bound, _ := json.Marshal(hostOf(l.Addr()))
+	b := &block.BlockData{
+		ID:   r.id,
+		Type: block.ConstBlockTypeBound,
+	}
+	b.Data = r.a.crypto.Seal(b.Nonce(), bound)
+	r.send(b)
+	r.log.Infof("bind on %v for %v", l.Addr(), expected.Address)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		defer close(accepted)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !expects(expected, conn.RemoteAddr()) {
+				r.log.Warnf("reject inbound connection from unexpected peer %v", conn.RemoteAddr())
+				_ = conn.Close()
+				continue
+			}
+			accepted <- conn
+			return
+		}
+	}()
+	// connection accepted after giving up is closed
+	abandon := func() {
+		_ = l.Close()
+		go func() {
+			if conn, ok := <-accepted; ok {
+				_ = conn.Close()
+			}
+		}()
+	}
+
+	timeout := time.NewTimer(r.a.conf.BindTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case conn, ok := <-accepted:
+			if !ok {
+				return nil, fmt.Errorf("bind listener is closed")
+			}
+			return conn, nil
+		case b := <-r.bus:
+			if b.Type == block.ConstBlockTypeResume {
+				continue
+			}
+			abandon()
+			return nil, fmt.Errorf("stream is closed while waiting for inbound connection, %v", b)
+		case <-timeout.C:
+			abandon()
+			return nil, fmt.Errorf("no inbound connection in %v, %w", r.a.conf.BindTimeout, os.ErrDeadlineExceeded)
+		case <-r.ctx.Done():
+			abandon()
+			return nil, r.ctx.Err()
+		}
+	}
+}
+
+// localIP returns ip client reaches agent at, nil while agent is parked
+func (a *Agent) localIP() net.IP {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.link == nil {
+		return nil
+	}
+	if addr, ok := a.link.Conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// expects reports whether inbound connection from addr is of expected peer,
+// any peer is expected if client does not tell its ip
+func expects(expected *block.HostData, addr net.Addr) bool {
+	ip := net.ParseIP(expected.Address)
+	if ip == nil || ip.IsUnspecified() {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && tcp.IP.Equal(ip)
+}
+
+// hostOf returns host data of tcp address addr
+func hostOf(addr net.Addr) *block.HostData {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return &block.HostData{}
+	}
+	return &block.HostData{
+		Address: tcp.IP.String(),
+		Port:    uint16(tcp.Port),
+	}
+}
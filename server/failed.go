@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sunliver/shark/lib/block"
+)
+
+// errDenied fails streams server does not serve
+var errDenied = errors.New("denied")
+
+// reasonOf returns reason of ConnectFailed block for error opening a stream
+func reasonOf(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return block.ConstFailedDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return block.ConstFailedRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return block.ConstFailedNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return block.ConstFailedHostUnreachable
+	case errors.Is(err, errDenied), errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return block.ConstFailedDenied
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return block.ConstFailedTimeout
+	default:
+		return block.ConstFailedUnknown
+	}
+}
+
+// connectFailed returns ConnectFailed block of stream id sealing reason
+func (a *Agent) connectFailed(id uuid.UUID, reason byte) *block.BlockData {
+	b := &block.BlockData{
+		ID:   id,
+		Type: block.ConstBlockTypeConnectFailed,
+	}
+	b.Data = a.crypto.Seal(b.Nonce(), []byte{reason})
+	return b
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sunliver/shark/lib/block"
+)
+
+func TestReasonOf(t *testing.T) {
+	dial := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	cases := []struct {
+		err    error
+		reason byte
+	}{
+		{dial(syscall.ECONNREFUSED), block.ConstFailedRefused},
+		{dial(syscall.ENETUNREACH), block.ConstFailedNetworkUnreachable},
+		{dial(syscall.EHOSTUNREACH), block.ConstFailedHostUnreachable},
+		{dial(syscall.EACCES), block.ConstFailedDenied},
+		{dial(syscall.ETIMEDOUT), block.ConstFailedTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "shark.invalid", IsNotFound: true}}, block.ConstFailedDNS},
+		{fmt.Errorf("bind is not negotiated, %w", errDenied), block.ConstFailedDenied},
+		{fmt.Errorf("no inbound connection, %w", os.ErrDeadlineExceeded), block.ConstFailedTimeout},
+		{fmt.Errorf("broken"), block.ConstFailedUnknown},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.reason, reasonOf(c.err), "%v", c.err)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"sync"
+)
+
+// Joins keeps striped streams by token, for other agents of the same user to join,
+// see block.FeatureMultipath
+type Joins struct {
+	relays map[string]*relay
+	mu     sync.Mutex
+}
+
+// NewJoins init empty joins
+func NewJoins() *Joins {
+	return &Joins{
+		relays: make(map[string]*relay),
+	}
+}
+
+// Add keeps relay by token
+func (j *Joins) Add(token []byte, r *relay) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.relays[string(token)] = r
+}
+
+// Lookup returns relay of token opened by user, nil if there is none
+func (j *Joins) Lookup(token []byte, user string) *relay {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if r, ok := j.relays[string(token)]; ok && r.a.user == user {
+		return r
+	}
+	return nil
+}
+
+// Remove forgets token of released relay
+func (j *Joins) Remove(token []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.relays, string(token))
+}
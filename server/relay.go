@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/sunliver/shark/lib/block"
+	"github.com/sunliver/shark/lib/crypto"
+	"github.com/sunliver/shark/lib/stream"
 )
 
 type relay struct {
@@ -18,28 +21,46 @@ type relay struct {
 	conn   net.Conn
 	a      *Agent
 	bus    chan *block.BlockData
+	window *block.Window
+	// retransmit keeps data blocks sent for resend
+	retransmit *block.Retransmit
+	// halves count directions shut down, see closeHalf
+	halves int32
+	// reorder puts data blocks striped by client back in order, nil without multipath
+	reorder *block.Reorder
+	// token other agents join the stream with, see block.FeatureMultipath
+	token []byte
+	// paths other agents stream is striped over
+	paths  *stream.Paths
 	log    logrus.FieldLogger
 	ctx    context.Context
 	cancel func()
 }
 
 const (
-	relayBusSz              = 16
+	// relayBusSz holds a full window, its resend and control blocks
+	relayBusSz              = block.ConstStreamWindow*2 + 4
 	remoteReadBufSz         = 4096
-	constRemoteReadTimeout  = time.Second * 60
 	constRemoteWriteTimeout = time.Second * 60
 )
 
 func newRelay(a *Agent, id uuid.UUID) *relay {
 	c, cancel := context.WithCancel(a.ctx)
-	return &relay{
-		id:     id,
-		ctx:    c,
-		cancel: cancel,
-		bus:    make(chan *block.BlockData, relayBusSz),
-		log:    logrus.WithField("relay", short(id)),
-		a:      a,
+	r := &relay{
+		id:         id,
+		ctx:        c,
+		cancel:     cancel,
+		bus:        make(chan *block.BlockData, relayBusSz),
+		window:     block.NewWindow(),
+		retransmit: block.NewRetransmit(),
+		paths:      stream.NewPaths(a.bus),
+		log:        a.log.WithField("relay", short(id)),
+		a:          a,
 	}
+	if a.multipath {
+		r.reorder = block.NewReorder()
+	}
+	return r
 }
 
 func (r *relay) run() {
@@ -47,75 +68,158 @@ func (r *relay) run() {
 	defer r.log.Debugf("run routine stop")
 	defer r.release()
 
-	// DecryptBlock may panic
-	defer func() {
-		if err := recover(); err != nil {
-			r.log.Errorf("recover from panic, %v", err)
-		}
-	}()
+	recv := stream.NewReceiver(r.id, r.a.resend, r.a.flowControl, r.send)
+	// log tells remote once it is connected, r.log is read by agent routines too
+	log := r.log
 
 	for {
 		select {
 		case <-r.ctx.Done():
 			err := r.ctx.Err()
-			r.log.Infof("relay closed, %v", err)
+			log.Infof("relay closed, %v", err)
 			return
 		case blockData, ok := <-r.bus:
 			if !ok {
-				r.log.Infof("r.bus is closed")
+				log.Infof("r.bus is closed")
 				return
 			}
 
-			r.log.Debugf("recv block, %v", blockData)
+			log.Debugf("recv block, %v", blockData)
+
+			if blockData.Type == block.ConstBlockTypeConnect || blockData.Type == block.ConstBlockTypeFastConnect ||
+				blockData.Type == block.ConstBlockTypeBind {
+				if r.conn != nil {
+					log.Errorf("stream is connected already, reject connect block")
+					return
+				}
 
-			if blockData.Type == block.ConstBlockTypeConnect {
-				var hosts block.HostData
+				// connect data is fast connect data without first data
+				var hosts block.FastConnectData
 				if len(blockData.Data) > 0 {
-					if err := json.Unmarshal(r.a.crypto.DecrypBlocks(blockData.Data), &hosts); err != nil {
-						r.log.Errorf("broken connect block, %v", err)
+					d, err := r.a.crypto.Open(blockData.Nonce(), blockData.Data)
+					if err != nil {
+						log.Errorf("reject connect block, %v", err)
+						r.send(&block.BlockData{
+							ID:   r.id,
+							Type: block.ConstBlockTypeConnectFailed,
+						})
+						return
+					}
+					if !r.a.acceptStream(r.id) {
+						log.Errorf("stream is opened before, reject replayed connect block")
+						return
+					}
+					if err := json.Unmarshal(d, &hosts); err != nil {
+						log.Errorf("broken connect block, %v", err)
 						return
 					}
 				} else {
-					r.log.Errorf("broken connect block, without hostdata")
+					log.Errorf("broken connect block, without hostdata")
 					return
 				}
 
-				conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", hosts.Address, hosts.Port))
+				bind := blockData.Type == block.ConstBlockTypeBind
+				var conn net.Conn
+				var err error
+				if bind {
+					conn, err = r.bind(&hosts.HostData)
+				} else {
+					conn, err = net.Dial("tcp", net.JoinHostPort(hosts.Address, fmt.Sprint(hosts.Port)))
+				}
 				if err != nil {
-					r.log.Errorf("connect remote failed, %v", err)
-					r.a.bus <- block.Marshal(&block.BlockData{
-						ID:   r.id,
-						Type: block.ConstBlockTypeConnectFailed,
-					})
+					log.Errorf("connect remote failed, %v", err)
+					r.send(r.a.connectFailed(r.id, reasonOf(err)))
 					return
 				}
 				r.conn = conn
-				r.log = r.log.WithField("conn", r.conn.RemoteAddr())
-				r.a.bus <- block.Marshal(&block.BlockData{
+				log = log.WithField("conn", r.conn.RemoteAddr())
+				if err := r.writeRemote(hosts.Data); err != nil {
+					log.Warnf("write to remote failed, %v", err)
+					return
+				}
+				connected := &block.BlockData{
 					ID:   r.id,
 					Type: block.ConstBlockTypeConnected,
-				})
+				}
+				if bind {
+					// client tells local app the peer of inbound connection, it is not striped
+					peer, _ := json.Marshal(hostOf(conn.RemoteAddr()))
+					connected.Data = r.a.crypto.Seal(connected.Nonce(), peer)
+				} else if r.a.multipath {
+					// client joins other relays with the token
+					r.token = crypto.NewNonce()
+					r.a.conf.Joins.Add(r.token, r)
+					connected.Data = r.a.crypto.Seal(connected.Nonce(), r.token)
+				}
+				r.send(connected)
 
 				go r.write()
 			} else {
 				if r.conn == nil {
 					// not connect remote yet
 					// wrong sequence
-					r.log.Errorf("conn is not init yet")
+					log.Errorf("conn is not init yet")
 					return
 				}
 
 				if blockData.Type == block.ConstBlockTypeData {
+					if next, err := recv.Data(blockData); err != nil {
+						log.Errorf("reject data block %v, %v", blockData, err)
+						r.send(&block.BlockData{
+							ID:   r.id,
+							Type: block.ConstBlockTypeDisconnect,
+						})
+						return
+					} else if !next {
+						// sent again, or sent before the broken one is resent
+						log.Debugf("drop data block %v, expected block num %v", blockData, recv.Num())
+						continue
+					}
+
 					if blockData.Length > 0 {
-						d := r.a.crypto.DecrypBlocks(blockData.Data)
-						if n, err := r.conn.Write(d); err != nil || n < len(d) {
-							r.log.Warnf("write to remote failed, %v", err)
+						d, err := r.a.crypto.Open(blockData.Nonce(), blockData.Data)
+						if err != nil {
+							log.Errorf("reject data block %v, %v", blockData, err)
+							r.send(&block.BlockData{
+								ID:   r.id,
+								Type: block.ConstBlockTypeDisconnect,
+							})
 							return
 						}
+						if err := r.writeRemote(d); err != nil {
+							log.Warnf("write to remote failed, %v", err)
+							return
+						}
+					}
+					recv.Consumed()
+				} else if blockData.Type == block.ConstBlockTypeInvalid {
+					if recv.Invalid(blockData) {
+						log.Warnf("broken data block %v, request resend", blockData)
+					}
+				} else if blockData.Type == block.ConstBlockTypeResume {
+					log.Infof("session resumed, request resend from %v", recv.Num())
+					recv.Resume()
+				} else if blockData.Type == block.ConstBlockTypeCloseWrite {
+					if next, err := recv.CloseWrite(blockData); err != nil {
+						log.Errorf("reject close write block %v, %v", blockData, err)
+						r.send(&block.BlockData{
+							ID:   r.id,
+							Type: block.ConstBlockTypeDisconnect,
+						})
+						return
+					} else if !next {
+						continue
 					}
+
+					log.Debugf("peer closed write")
+					closeWrite(r.conn)
+					r.closeHalf()
+				} else if blockData.Type == block.ConstBlockTypeDisconnect {
+					log.Infof("peer closed stream")
+					return
 				} else {
 					// simply drop the package
-					r.log.Warnf("unrecognized block, %v", blockData)
+					log.Warnf("unrecognized block, %v", blockData)
 				}
 			}
 		}
@@ -134,12 +238,35 @@ func (r *relay) write() {
 			r.log.Infof("write is canceled, %v", r.ctx.Err())
 			return
 		default:
+			if r.a.flowControl {
+				if err := r.window.Wait(r.ctx, blockNum); err != nil {
+					r.log.Infof("write is canceled, %v", err)
+					return
+				}
+			}
+
 			buf := make([]byte, remoteReadBufSz)
 			n, err := io.ReadAtLeast(r.conn, buf, 1)
 			if err != nil {
+				if r.ctx.Err() != nil {
+					// conn is closed by release
+					return
+				}
+				if err == io.EOF && r.a.halfClose {
+					r.log.Debugf("remote closed write")
+					r.sendData(&block.BlockData{
+						ID:       r.id,
+						BlockNum: blockNum,
+						Type:     block.ConstBlockTypeCloseWrite,
+					})
+					r.closeHalf()
+					// peer may still write to remote
+					<-r.ctx.Done()
+					return
+				}
 				r.log.Warnf("read from remote failed, %v", err)
 
-				r.a.bus <- block.Marshal(&block.BlockData{
+				r.send(&block.BlockData{
 					ID:       r.id,
 					BlockNum: blockNum,
 					Type:     block.ConstBlockTypeDisconnect,
@@ -147,20 +274,136 @@ func (r *relay) write() {
 				return
 			}
 
-			r.a.bus <- block.Marshal(&block.BlockData{
+			blockData := &block.BlockData{
 				ID:       r.id,
 				BlockNum: blockNum,
 				Type:     block.ConstBlockTypeData,
-				Data:     r.a.crypto.CryptBlocks(buf[:n]),
-			})
+			}
+			blockData.Data = r.a.crypto.Seal(blockData.Nonce(), buf[:n])
+			r.sendData(blockData)
 			blockNum++
 		}
 	}
 }
 
+// writeRemote writes to remote, remote not reading for constRemoteWriteTimeout is dead
+func (r *relay) writeRemote(d []byte) error {
+	_ = r.conn.SetWriteDeadline(time.Now().Add(constRemoteWriteTimeout))
+	n, err := r.conn.Write(d)
+	if err == nil && n < len(d) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// deliver passes block to run routine; with flow control the bus holds a full window,
+// so it never blocks the agent unless peer overruns the window
+func (r *relay) deliver(b *block.BlockData) bool {
+	if r.reorder != nil {
+		return r.reorder.Push(b, r.push)
+	}
+	return r.push(b)
+}
+
+func (r *relay) push(b *block.BlockData) bool {
+	if !r.a.flowControl {
+		r.bus <- b
+		return true
+	}
+
+	select {
+	case r.bus <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// abort closes stream on protocol violation, tells peer to close it too
+func (r *relay) abort() {
+	r.send(&block.BlockData{
+		ID:   r.id,
+		Type: block.ConstBlockTypeDisconnect,
+	})
+	r.cancel()
+}
+
+// closeHalf marks one direction shut down, stream is released once both are
+func (r *relay) closeHalf() {
+	if atomic.AddInt32(&r.halves, 1) == 2 {
+		r.release()
+	}
+}
+
+// closeWrite shuts down writing side of conn, if conn supports half-close
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	}
+}
+
+// sendData sends data or close write block, keeps it for resend
+func (r *relay) sendData(b *block.BlockData) {
+	if r.a.resend {
+		r.retransmit.Send(b, r.stripe)
+	} else {
+		r.send(b)
+	}
+}
+
+// stripe sends data block over the agents stream is striped over
+func (r *relay) stripe(b *block.BlockData) {
+	r.paths.Stripe(b, r.send, r.ctx.Done())
+}
+
+// join stripes stream over agent a, which carries its blocks with stream id;
+// it returns false once relay is released
+func (r *relay) join(a *Agent, id uuid.UUID) bool {
+	if !r.paths.Join(&stream.Path{Conn: a, ID: id, Bus: a.bus, Done: a.ctx.Done()}) {
+		return false
+	}
+	r.log.Debugf("stream joined agent %v", short(a.ID))
+	return true
+}
+
+// dropPath stops striping over closed agent a, blocks peer did not consume
+// may be gone with it and are sent again
+func (r *relay) dropPath(a *Agent) {
+	if r.paths.Drop(a) {
+		r.log.Infof("path is closed, resend from %v", r.window.Acked())
+		r.resend(r.window.Acked())
+	}
+}
+
+// resend sends data blocks again from num, peer got a broken one
+func (r *relay) resend(num uint32) {
+	if !r.a.resend || !r.retransmit.Resend(num, r.send) {
+		r.log.Errorf("can not resend data block %v, close stream", num)
+		r.abort()
+	}
+}
+
+// send queues block to agent, gives up once stream is closed
+func (r *relay) send(b *block.BlockData) {
+	select {
+	case r.a.bus <- b:
+	case <-r.ctx.Done():
+	}
+}
+
 func (r *relay) release() {
 	r.a.unregisterRelay(r)
 	r.cancel()
+	if r.token != nil {
+		r.a.conf.Joins.Remove(r.token)
+	}
+	// a draining agent may be released by leaving
+	for _, p := range r.paths.Close() {
+		p.Conn.(*Agent).leave(p.ID)
+	}
+	if r.conn != nil {
+		r.conn.Close()
+	}
 
 	r.log.Debugf("relay is released")
 }
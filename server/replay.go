@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers client nonces of handshakes in the last window,
+// handshakes with stale timestamp or seen nonce are rejected
+type ReplayCache struct {
+	window time.Duration
+	size   int
+	seen   map[string]time.Time
+	// queue in insertion order, oldest first
+	queue []string
+	mu    sync.Mutex
+}
+
+// NewReplayCache init cache holding at most size nonces
+func NewReplayCache(window time.Duration, size int) *ReplayCache {
+	return &ReplayCache{
+		window: window,
+		size:   size,
+		seen:   make(map[string]time.Time, size),
+	}
+}
+
+// Check reports error if timestamp is out of window or nonce was seen,
+// it rejects replays early; handshakes are only taken by CheckAndAdd
+func (c *ReplayCache) Check(nonce []byte, timestamp int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.check(nonce, timestamp, time.Now())
+}
+
+// CheckAndAdd checks nonce of an authenticated handshake as Check does and remembers it,
+// at once so that concurrent handshakes of the same nonce are not both taken;
+// the oldest nonce is dropped when cache is full
+func (c *ReplayCache) CheckAndAdd(nonce []byte, timestamp int64) error {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.check(nonce, timestamp, now); err != nil {
+		return err
+	}
+	for len(c.queue) > 0 {
+		oldest := c.queue[0]
+		if len(c.queue) < c.size && now.Sub(c.seen[oldest]) <= 2*c.window {
+			break
+		}
+		delete(c.seen, oldest)
+		c.queue = c.queue[1:]
+	}
+
+	c.seen[string(nonce)] = now
+	c.queue = append(c.queue, string(nonce))
+	return nil
+}
+
+func (c *ReplayCache) check(nonce []byte, timestamp int64, now time.Time) error {
+	ts := time.Unix(timestamp, 0)
+	if ts.Before(now.Add(-c.window)) || ts.After(now.Add(c.window)) {
+		return fmt.Errorf("handshake timestamp %v is out of window, check the clock", ts)
+	}
+	if _, ok := c.seen[string(nonce)]; ok {
+		return fmt.Errorf("handshake nonce is replayed")
+	}
+	return nil
+}
+
+const (
+	replayWindowSz = 1024
+)
+
+// replayWindow accepts every stream sequence at most once, sequences may
+// arrive out of order within replayWindowSz; see RFC 6479
+type replayWindow struct {
+	max    uint32
+	bitmap [replayWindowSz / 64]uint64
+}
+
+// Accept reports whether seq is fresh, and marks it as seen
+func (w *replayWindow) Accept(seq uint32) bool {
+	if seq == 0 {
+		return false
+	}
+
+	if seq > w.max {
+		shift := seq - w.max
+		if shift >= replayWindowSz {
+			w.bitmap = [replayWindowSz / 64]uint64{}
+		} else {
+			for i := uint32(1); i <= shift; i++ {
+				w.clear(w.max + i)
+			}
+		}
+		w.max = seq
+		w.set(seq)
+		return true
+	}
+
+	if w.max-seq >= replayWindowSz {
+		// too old
+		return false
+	}
+	if w.isSet(seq) {
+		return false
+	}
+	w.set(seq)
+	return true
+}
+
+func (w *replayWindow) set(seq uint32) {
+	idx := seq % replayWindowSz
+	w.bitmap[idx/64] |= 1 << (idx % 64)
+}
+
+func (w *replayWindow) clear(seq uint32) {
+	idx := seq % replayWindowSz
+	w.bitmap[idx/64] &^= 1 << (idx % 64)
+}
+
+func (w *replayWindow) isSet(seq uint32) bool {
+	idx := seq % replayWindowSz
+	return w.bitmap[idx/64]&(1<<(idx%64)) != 0
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayCache(t *testing.T) {
+	c := NewReplayCache(time.Minute, 2)
+	now := time.Now().Unix()
+
+	assert.Nil(t, c.Check([]byte("a"), now))
+	assert.Nil(t, c.CheckAndAdd([]byte("a"), now))
+	assert.NotNil(t, c.Check([]byte("a"), now))
+	assert.NotNil(t, c.CheckAndAdd([]byte("a"), now))
+
+	// stale or future timestamp
+	assert.NotNil(t, c.Check([]byte("b"), now-120))
+	assert.NotNil(t, c.Check([]byte("b"), now+120))
+	assert.NotNil(t, c.CheckAndAdd([]byte("b"), now-120))
+
+	// bounded, the oldest is dropped
+	assert.Nil(t, c.CheckAndAdd([]byte("b"), now))
+	assert.Nil(t, c.CheckAndAdd([]byte("c"), now))
+	assert.Len(t, c.seen, 2)
+	assert.Nil(t, c.Check([]byte("a"), now))
+	assert.NotNil(t, c.Check([]byte("c"), now))
+}
+
+func TestReplayCacheConcurrent(t *testing.T) {
+	c := NewReplayCache(time.Minute, 64)
+	now := time.Now().Unix()
+
+	// concurrent handshakes of the same nonce, only one is taken
+	var taken int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.CheckAndAdd([]byte("a"), now) == nil {
+				atomic.AddInt32(&taken, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), taken)
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	assert.False(t, w.Accept(0))
+	assert.True(t, w.Accept(1))
+	assert.False(t, w.Accept(1))
+
+	// out of order
+	assert.True(t, w.Accept(5))
+	assert.True(t, w.Accept(3))
+	assert.True(t, w.Accept(2))
+	assert.False(t, w.Accept(3))
+	assert.True(t, w.Accept(4))
+
+	// slide
+	assert.True(t, w.Accept(5+replayWindowSz))
+	assert.False(t, w.Accept(5))
+	assert.True(t, w.Accept(6+replayWindowSz))
+	assert.False(t, w.Accept(6+replayWindowSz))
+	assert.True(t, w.Accept(7))
+
+	// jump
+	assert.True(t, w.Accept(100*replayWindowSz))
+	assert.False(t, w.Accept(100*replayWindowSz))
+	assert.True(t, w.Accept(100*replayWindowSz-1))
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Sessions keeps resumable agents by ticket. An agent losing its connection
+// is parked for timeout, then released unless its client resumes the session
+type Sessions struct {
+	timeout  time.Duration
+	sessions map[string]*session
+	mu       sync.Mutex
+}
+
+type session struct {
+	a *Agent
+	// timer releases parked agent, nil while agent is connected
+	timer *time.Timer
+}
+
+// NewSessions init sessions parked for timeout
+func NewSessions(timeout time.Duration) *Sessions {
+	return &Sessions{
+		timeout:  timeout,
+		sessions: make(map[string]*session),
+	}
+}
+
+// Add keeps agent by its ticket
+func (s *Sessions) Add(a *Agent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[string(a.ticket)] = &session{a: a}
+}
+
+// Lookup returns agent of ticket bound to user, nil if there is none
+func (s *Sessions) Lookup(ticket []byte, user string) *Agent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.sessions[string(ticket)]; ok && e.a.user == user {
+		return e.a
+	}
+	return nil
+}
+
+// Take returns agent of ticket bound to user to resume on a new connection,
+// nil if there is none or it is expiring
+func (s *Sessions) Take(ticket []byte, user string) *Agent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[string(ticket)]
+	if !ok || e.a.user != user {
+		return nil
+	}
+	if e.timer != nil {
+		if !e.timer.Stop() {
+			return nil
+		}
+		e.timer = nil
+	}
+	return e.a
+}
+
+// Park releases agent after timeout, unless it is resumed before
+func (s *Sessions) Park(a *Agent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[string(a.ticket)]
+	if !ok || e.a != a {
+		return
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.timer = time.AfterFunc(s.timeout, func() {
+		s.expire(a)
+	})
+}
+
+func (s *Sessions) expire(a *Agent) {
+	s.mu.Lock()
+	e, ok := s.sessions[string(a.ticket)]
+	if ok && e.a == a {
+		e.timer = nil
+	}
+	s.mu.Unlock()
+
+	if ok && e.a == a {
+		a.expire()
+	}
+}
+
+// Remove forgets released agent
+func (s *Sessions) Remove(a *Agent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.sessions[string(a.ticket)]; ok && e.a == a {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		delete(s.sessions, string(a.ticket))
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parked(s *Sessions, user string) *Agent {
+	conn, _ := net.Pipe()
+	a := NewServer(context.Background(), conn, &Conf{Sessions: s})
+	a.user = user
+	a.ticket = []byte(user + " ticket")
+	a.link = nil
+	return a
+}
+
+func TestSessions(t *testing.T) {
+	s := NewSessions(time.Millisecond * 50)
+	a := parked(s, "alice")
+	s.Add(a)
+
+	// ticket is bound to user
+	assert.Equal(t, a, s.Lookup(a.ticket, "alice"))
+	assert.Nil(t, s.Lookup(a.ticket, "bob"))
+	assert.Nil(t, s.Lookup([]byte("guess"), "alice"))
+	assert.Nil(t, s.Take(a.ticket, "bob"))
+
+	// taken before timeout
+	s.Park(a)
+	assert.Equal(t, a, s.Take(a.ticket, "alice"))
+	time.Sleep(time.Millisecond * 100)
+	assert.Nil(t, a.ctx.Err())
+
+	// released after timeout
+	s.Park(a)
+	time.Sleep(time.Millisecond * 100)
+	assert.NotNil(t, a.ctx.Err())
+	assert.Nil(t, s.Lookup(a.ticket, "alice"))
+	assert.Nil(t, s.Take(a.ticket, "alice"))
+}
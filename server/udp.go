@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/sunliver/shark/lib/block"
+)
+
+const (
+	associationBusSz = 64
+	datagramBufSz    = 64 * 1024
+)
+
+// association forwards datagrams of a UDP association opened by client through
+// its own UDP socket, see block.FeatureUDP; it is closed once idle for Conf.UDPTimeout
+type association struct {
+	id     uuid.UUID
+	a      *Agent
+	conn   *net.UDPConn
+	ctx    context.Context
+	cancel func()
+	bus    chan *block.BlockData
+	idle   *time.Timer
+	once   sync.Once
+	log    logrus.FieldLogger
+}
+
+// associate opens UDP association of associate block b
+func (a *Agent) associate(b *block.BlockData) {
+	// associate block carries address client sends datagrams from, only sealed
+	// so that it can not be forged
+	var hint block.HostData
+	d, err := a.crypto.Open(b.Nonce(), b.Data)
+	if err == nil {
+		err = json.Unmarshal(d, &hint)
+	}
+	if err != nil {
+		a.log.Errorf("reject associate block %v, %v", b, err)
+		a.send(a.connectFailed(b.ID, block.ConstFailedUnknown))
+		return
+	}
+	if !a.udp {
+		a.log.Errorf("reject associate block %v, udp is not negotiated", b)
+		a.send(a.connectFailed(b.ID, block.ConstFailedDenied))
+		return
+	}
+	if !a.acceptStream(b.ID) {
+		a.log.Errorf("stream is opened before, reject replayed associate block")
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		a.log.Errorf("listen udp failed, %v", err)
+		a.send(a.connectFailed(b.ID, reasonOf(err)))
+		return
+	}
+
+	c, cancel := context.WithCancel(a.ctx)
+	as := &association{
+		id:     b.ID,
+		a:      a,
+		conn:   conn,
+		ctx:    c,
+		cancel: cancel,
+		bus:    make(chan *block.BlockData, associationBusSz),
+		log:    a.log.WithField("association", short(b.ID)).WithField("udp", conn.LocalAddr()),
+	}
+	if !a.associations.Add(b.ID, as) {
+		as.release()
+		return
+	}
+	as.idle = time.AfterFunc(a.conf.UDPTimeout, func() {
+		as.log.Infof("association is idle for %v, close it", a.conf.UDPTimeout)
+		as.abort()
+	})
+	as.log.Infof("udp associate for %v:%v", hint.Address, hint.Port)
+
+	a.send(&block.BlockData{
+		ID:   b.ID,
+		Type: block.ConstBlockTypeConnected,
+	})
+	go as.run()
+	go as.read()
+}
+
+// association returns UDP association of id, nil if there is none
+func (a *Agent) association(id uuid.UUID) *association {
+	if as, ok := a.associations.Get(id).(*association); ok {
+		return as
+	}
+	return nil
+}
+
+// deliver passes block to run routine, datagrams are dropped if it is behind
+func (as *association) deliver(b *block.BlockData) {
+	select {
+	case as.bus <- b:
+	default:
+		as.log.Debugf("association is behind, drop block %v", b)
+	}
+}
+
+// run sends datagrams from client to their destinations
+func (as *association) run() {
+	defer as.release()
+
+	// block num expected of next datagram block
+	var recvNum uint32
+	for {
+		select {
+		case <-as.ctx.Done():
+			return
+		case b := <-as.bus:
+			if b.Type == block.ConstBlockTypeDisconnect {
+				as.log.Infof("association is closed by client")
+				return
+			}
+			if b.Type != block.ConstBlockTypeDatagram || b.BlockNum < recvNum {
+				as.log.Debugf("drop block %v, expected block num %v", b, recvNum)
+				continue
+			}
+
+			d, err := as.a.crypto.Open(b.Nonce(), b.Data)
+			if err != nil {
+				as.log.Warnf("drop broken datagram block %v, %v", b, err)
+				continue
+			}
+			recvNum = b.BlockNum + 1
+			datagram, err := block.UnMarshalDatagram(d)
+			if err != nil {
+				as.log.Warnf("drop datagram block %v, %v", b, err)
+				continue
+			}
+
+			addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(datagram.Address, fmt.Sprint(datagram.Port)))
+			if err != nil {
+				as.log.Warnf("drop datagram to %v:%v, %v", datagram.Address, datagram.Port, err)
+				continue
+			}
+			if _, err := as.conn.WriteToUDP(datagram.Data, addr); err != nil {
+				as.log.Warnf("write datagram to %v failed, %v", addr, err)
+				continue
+			}
+			as.idle.Reset(as.a.conf.UDPTimeout)
+		}
+	}
+}
+
+// read sends datagrams to client with their sources
+func (as *association) read() {
+	defer as.release()
+
+	var sendNum uint32
+	buf := make([]byte, datagramBufSz)
+	for {
+		n, addr, err := as.conn.ReadFromUDP(buf)
+		if err != nil {
+			if as.ctx.Err() == nil {
+				as.log.Errorf("read datagram failed, %v", err)
+				as.abort()
+			}
+			return
+		}
+
+		d, err := block.MarshalDatagram(&block.DatagramData{
+			HostData: block.HostData{
+				Address: addr.IP.String(),
+				Port:    uint16(addr.Port),
+			},
+			Data: buf[:n],
+		})
+		if err != nil {
+			as.log.Warnf("drop datagram from %v, %v", addr, err)
+			continue
+		}
+		b := &block.BlockData{
+			ID:       as.id,
+			Type:     block.ConstBlockTypeDatagram,
+			BlockNum: sendNum,
+		}
+		b.Data = as.a.crypto.Seal(b.Nonce(), d)
+		sendNum++
+		as.a.send(b)
+		as.idle.Reset(as.a.conf.UDPTimeout)
+	}
+}
+
+// abort closes association, tells client to close it too
+func (as *association) abort() {
+	as.a.send(&block.BlockData{
+		ID:   as.id,
+		Type: block.ConstBlockTypeDisconnect,
+	})
+	as.release()
+}
+
+func (as *association) release() {
+	as.once.Do(func() {
+		as.cancel()
+		if as.idle != nil {
+			as.idle.Stop()
+		}
+		_ = as.conn.Close()
+		as.a.associations.Remove(as.id)
+
+		as.log.Debugf("association is released")
+	})
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// User account sharing the server, with its own pre-shared key
+type User struct {
+	Name    string `json:"Name"`
+	Key     string `json:"Key"`
+	Enabled bool   `json:"Enabled"`
+}
+
+// Users accounts loaded from a json users file, e.g.
+//
+//	[{"Name": "alice", "Key": "secret", "Enabled": true}]
+//
+// the file is reloaded when it changes, so users can be revoked without restart;
+// agents of a user disabled or removed are closed
+type Users struct {
+	path    string
+	modTime time.Time
+	users   map[string]*User
+	// agents live agents by user name, guarded by mu
+	agents map[string]map[*Agent]struct{}
+	mu     sync.RWMutex
+	log    logrus.FieldLogger
+}
+
+// LoadUsers reads users file
+func LoadUsers(path string) (*Users, error) {
+	u := &Users{
+		path:   path,
+		agents: make(map[string]map[*Agent]struct{}),
+		log:    logrus.WithField("users", path),
+	}
+
+	if err := u.reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Lookup returns enabled user by name
+func (u *Users) Lookup(name string) (*User, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	user, ok := u.users[name]
+	if !ok || !user.Enabled {
+		return nil, false
+	}
+	return user, true
+}
+
+// Watch reloads users file every interval if it is modified
+func (u *Users) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := u.reload(); err != nil {
+				u.log.Errorf("reload users failed, keep the old ones, %v", err)
+			}
+		}
+	}
+}
+
+func (u *Users) reload() error {
+	info, err := os.Stat(u.path)
+	if err != nil {
+		return err
+	}
+
+	u.mu.RLock()
+	modTime := u.modTime
+	u.mu.RUnlock()
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parse users file failed, %v", err)
+	}
+
+	users := make(map[string]*User, len(list))
+	for _, user := range list {
+		if user.Name == "" || user.Key == "" {
+			return fmt.Errorf("user without name or key")
+		}
+		if _, ok := users[user.Name]; ok {
+			return fmt.Errorf("duplicated user %v", user.Name)
+		}
+		users[user.Name] = user
+	}
+
+	u.mu.Lock()
+	u.users = users
+	u.modTime = info.ModTime()
+	var revoked []*Agent
+	for name, agents := range u.agents {
+		if user, ok := users[name]; ok && user.Enabled {
+			continue
+		}
+		for a := range agents {
+			revoked = append(revoked, a)
+		}
+		delete(u.agents, name)
+	}
+	u.mu.Unlock()
+
+	u.log.Infof("users loaded, %v", len(users))
+	for _, a := range revoked {
+		a.log.Warnf("user is revoked, close agent")
+		a.release()
+	}
+	return nil
+}
+
+// attach keeps agent of its user until it is released, it is closed once the user is revoked;
+// it returns false if the user is revoked already
+func (u *Users) attach(a *Agent) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if user, ok := u.users[a.user]; !ok || !user.Enabled {
+		return false
+	}
+	if u.agents[a.user] == nil {
+		u.agents[a.user] = make(map[*Agent]struct{})
+	}
+	u.agents[a.user][a] = struct{}{}
+	return true
+}
+
+// detach forgets released agent
+func (u *Users) detach(a *Agent) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if agents, ok := u.agents[a.user]; ok {
+		delete(agents, a)
+		if len(agents) == 0 {
+			delete(u.agents, a.user)
+		}
+	}
+}
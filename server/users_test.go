@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeUsers(t *testing.T, path, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shark")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	now := time.Now()
+	writeUsers(t, path, `[
+		{"Name": "alice", "Key": "alice-key", "Enabled": true},
+		{"Name": "bob", "Key": "bob-key", "Enabled": false}
+	]`, now)
+
+	users, err := LoadUsers(path)
+	assert.Nil(t, err)
+
+	alice, ok := users.Lookup("alice")
+	assert.True(t, ok)
+	assert.Equal(t, "alice-key", alice.Key)
+
+	_, ok = users.Lookup("bob")
+	assert.False(t, ok)
+	_, ok = users.Lookup("carol")
+	assert.False(t, ok)
+
+	// revoke alice, enable bob
+	writeUsers(t, path, `[
+		{"Name": "alice", "Key": "alice-key", "Enabled": false},
+		{"Name": "bob", "Key": "bob-key", "Enabled": true}
+	]`, now.Add(time.Second))
+	assert.Nil(t, users.reload())
+
+	_, ok = users.Lookup("alice")
+	assert.False(t, ok)
+	_, ok = users.Lookup("bob")
+	assert.True(t, ok)
+
+	// broken file keeps the old users
+	writeUsers(t, path, `[{"Name": "bob"}]`, now.Add(2*time.Second))
+	assert.NotNil(t, users.reload())
+	_, ok = users.Lookup("bob")
+	assert.True(t, ok)
+}
+
+func TestLoadUsersBroken(t *testing.T) {
+	_, err := LoadUsers("/not/exist/users.json")
+	assert.NotNil(t, err)
+}
@@ -1,8 +1,8 @@
 package mock
 
 import (
+	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"testing"
 
@@ -11,7 +11,7 @@ import (
 	"github.com/sunliver/shark/lib/crypto"
 )
 
-func NewEchoServer(t *testing.T, port int, uuid uuid.UUID) {
+func NewEchoServer(t *testing.T, port int, uuid uuid.UUID, key []byte) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		t.Fatal(err)
@@ -27,84 +27,87 @@ func NewEchoServer(t *testing.T, port int, uuid uuid.UUID) {
 			t.Fatal(err)
 		}
 		defer conn.Close()
+		r := block.NewReader(conn, 0)
 
 		// handshake 1
+		var clientHello, serverHello, shared []byte
+		var cipher string
 		{
-			header := make([]byte, block.ConstBlockHeaderSzB)
-			if n, err := io.ReadFull(conn, header); err != nil || n != block.ConstBlockHeaderSzB {
-				t.Fatal(err)
+			blockdata := readBlock(t, r)
+			if blockdata.Type != block.ConstBlockTypeHandShake {
+				t.Fatal("invalid handshake")
 			}
 
-			blockdata, err := block.UnMarshal(header)
-			if err != nil {
+			var hello block.HandShakeData
+			if err := json.Unmarshal(blockdata.Data, &hello); err != nil {
 				t.Fatal(err)
 			}
+			clientHello = blockdata.Data
+			cipher = hello.OfferedCiphers()[0]
 
-			if blockdata.Type != block.ConstBlockTypeHandShake {
-				t.Fatal("invalid handshake")
+			keyPair := crypto.NewKeyPair()
+			if shared, err = keyPair.SharedSecret(hello.PublicKey); err != nil {
+				t.Fatal(err)
 			}
 
+			serverHello, _ = json.Marshal(&block.HandShakeData{
+				Version:   block.ConstProtocolVersion1,
+				Nonce:     crypto.NewNonce(),
+				PublicKey: keyPair.Public,
+				Cipher:    cipher,
+			})
 			if _, err := conn.Write(block.Marshal(&block.BlockData{
 				ID:   uuid,
 				Type: block.ConstBlockTypeHandShake,
+				Data: serverHello,
 			})); err != nil {
 				t.Fatal(err)
 			}
 		}
 
 		// handshake 2
-		var passwd []byte
 		{
-			header := make([]byte, block.ConstBlockHeaderSzB)
-
-			if n, err := io.ReadFull(conn, header); err != nil || n != block.ConstBlockHeaderSzB {
-				t.Fatal(err)
-			}
-
-			blockHeader, err := block.UnMarshalHeader(header)
-			if err != nil {
-				t.Fatal(err)
-			}
-
+			blockHeader := readBlock(t, r)
 			if blockHeader.Type != block.ConstBlockTypeHandShakeResponse {
 				t.Fatal("invalid handshake resp")
 			}
 
-			body := make([]byte, blockHeader.Length)
-			if n, err := io.ReadFull(conn, body); err != nil || int32(n) != blockHeader.Length {
+			var resp block.HandShakeData
+			if err := json.Unmarshal(blockHeader.Data, &resp); err != nil {
 				t.Fatal(err)
 			}
+			if !crypto.VerifyProof(crypto.ClientProof(key, clientHello, serverHello), resp.Proof) {
+				t.Fatal("invalid client proof")
+			}
 
-			passwd = body
-
+			data, _ := json.Marshal(&block.HandShakeData{
+				Proof: crypto.ServerProof(key, clientHello, serverHello),
+			})
 			if _, err := conn.Write(block.Marshal(&block.BlockData{
 				ID:   uuid,
 				Type: block.ConstBlockTypeHandShakeFinal,
+				Data: data,
 			})); err != nil {
 				t.Fatal(err)
 			}
 		}
 
-		crypto := crypto.NewCrypto(passwd)
+		c2s, s2c := crypto.TrafficKeys(key, shared, clientHello, serverHello)
+		session, err := crypto.NewSession(cipher, s2c, c2s)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		for {
-			header := make([]byte, block.ConstBlockHeaderSzB)
-			if n, err := io.ReadFull(conn, header); err != nil || n != block.ConstBlockHeaderSzB {
-				t.Fatal(err)
-			}
-
-			blockHeader, err := block.UnMarshal(header)
-			if err != nil {
-				t.Fatal(err)
-			}
+			blockHeader := readBlock(t, r)
 
 			switch blockHeader.Type {
 			case block.ConstBlockTypeConnect:
-				body := make([]byte, blockHeader.Length)
-				if n, err := io.ReadFull(conn, body); err != nil || n != int(blockHeader.Length) {
+				d, err := session.Open(blockHeader.Nonce(), blockHeader.Data)
+				if err != nil {
 					t.Fatal(err)
 				}
-				t.Logf("remote server recv connect msg, %v", string(crypto.DecrypBlocks(body)))
+				t.Logf("remote server recv connect msg, %v", string(d))
 
 				if _, err := conn.Write(block.Marshal(&block.BlockData{
 					ID:   blockHeader.ID,
@@ -113,18 +116,18 @@ func NewEchoServer(t *testing.T, port int, uuid uuid.UUID) {
 					t.Fatal(err)
 				}
 			case block.ConstBlockTypeData:
-				body := make([]byte, blockHeader.Length)
-				if n, err := io.ReadFull(conn, body); err != nil || int32(n) != blockHeader.Length {
+				d, err := session.Open(blockHeader.Nonce(), blockHeader.Data)
+				if err != nil {
 					t.Fatal(err)
 				}
 
-				// t.Logf("recv data, %v", string(crypto.DecrypBlocks(body)))
-
-				if _, err := conn.Write(block.Marshal(&block.BlockData{
-					ID:   blockHeader.ID,
-					Type: block.ConstBlockTypeData,
-					Data: body,
-				})); err != nil {
+				echo := &block.BlockData{
+					ID:       blockHeader.ID,
+					Type:     block.ConstBlockTypeData,
+					BlockNum: blockHeader.BlockNum,
+				}
+				echo.Data = session.Seal(echo.Nonce(), d)
+				if _, err := conn.Write(block.Marshal(echo)); err != nil {
 					t.Fatal(err)
 				}
 
@@ -135,3 +138,11 @@ func NewEchoServer(t *testing.T, port int, uuid uuid.UUID) {
 		}
 	}
 }
+
+func readBlock(t *testing.T, r *block.Reader) *block.BlockData {
+	blockdata, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blockdata
+}